@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a subcommand such as safehaven keygen. Without one, safehaven runs the VPN.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"keygen":    {"print a new WireGuard private key", keygen},
+	"pubkey":    {"read a private key from stdin and print its public key", pubkey},
+	"genpsk":    {"print a new WireGuard preshared key", genpsk},
+	"peer":      {"manage the peers of a server config file (peer add)", peer},
+	"status":    {"show the peers of the running daemon", status},
+	"route":     {"change the routes through the tunnel of the running client (route add|del <dst>)", route},
+	"reconnect": {"make the running client reconnect to the server", reconnect},
+}
+
+// runCommand runs the named subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return 2
+	}
+	if err := command.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n  %s %-9s run the VPN\n", os.Args[0], "[flags]")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %-9s %s\n", os.Args[0], name, commands[name].usage)
+	}
+}
+
+func keygen(args []string) error {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func pubkey(args []string) error {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return errors.New("expected a private key on stdin")
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	fmt.Println(key.PublicKey())
+	return nil
+}
+
+func genpsk(args []string) error {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture runs a subcommand with stdin fed from input and returns what it printed on stdout
+func capture(t *testing.T, command func([]string) error, args []string, input string) (string, error) {
+	t.Helper()
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+
+	inputFile, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inputFile.Close()
+	if _, err := inputFile.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		printed, _ := io.ReadAll(reader)
+		output <- string(printed)
+	}()
+
+	os.Stdin, os.Stdout = inputFile, writer
+	err = command(args)
+	writer.Close()
+	return <-output, err
+}
+
+func TestKeygenAndPubkey(t *testing.T) {
+	printed, err := capture(t, keygen, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := wgtypes.ParseKey(strings.TrimSpace(printed))
+	if err != nil {
+		t.Fatalf("keygen printed %q: %v", printed, err)
+	}
+
+	printed, err = capture(t, pubkey, nil, privateKey.String()+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := privateKey.PublicKey().String() + "\n"; printed != want {
+		t.Errorf("pubkey printed %q, want %q", printed, want)
+	}
+	// A key piped in without a trailing newline works too
+	if printed, err := capture(t, pubkey, nil, privateKey.String()); err != nil || strings.TrimSpace(printed) != privateKey.PublicKey().String() {
+		t.Errorf("pubkey printed %q, %v", printed, err)
+	}
+}
+
+func TestPubkeyInvalid(t *testing.T) {
+	if _, err := capture(t, pubkey, nil, ""); err == nil {
+		t.Error("empty stdin accepted")
+	}
+	if _, err := capture(t, pubkey, nil, "not a key\n"); err == nil {
+		t.Error("invalid key accepted")
+	}
+}
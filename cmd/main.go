@@ -2,37 +2,149 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/control"
 	"github.com/kwakubiney/safehaven/pkg/vpn"
 	"github.com/kwakubiney/safehaven/pkg/vpn/plain"
 	wg2 "github.com/kwakubiney/safehaven/pkg/vpn/wg"
+	"github.com/kwakubiney/safehaven/utils"
 	"github.com/kwakubiney/safehaven/wg"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
-func setupConfig() (*config.Config, error) {
-	cfg := &config.Config{}
+// setupConfig builds the configuration from args and the config file they point to. It is
+// called again on SIGHUP to pick up changes to the file.
+func setupConfig(args []string) (*config.Config, error) {
+	cfg := &config.Config{Routes: []string{"10.108.0.2"}, MTU: 1500}
+	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 	// Basic VPN flags
-	flag.StringVar(&cfg.ClientTunIP, "tc", "192.168.1.100/24", "client tun device ip")
-	flag.StringVar(&cfg.ServerTunIP, "ts", "192.168.1.102/24", "server tun device ip")
-	flag.StringVar(&cfg.ServerAddress, "s", "138.197.32.138:3000", "server address")
-	flag.StringVar(&cfg.LocalAddress, "l", "3000", "local address")
-	flag.StringVar(&cfg.TunName, "tname", "tun0", "tun interface name")
-	flag.BoolVar(&cfg.Global, "g", false, "global")
-	flag.StringVar(&cfg.DestinationAddress, "d", "10.108.0.2", "destination host/network address")
-	flag.BoolVar(&cfg.ServerMode, "srv", false, "server mode")
-	wgConfigPath := flag.String("wg", "", "Path to WireGuard configuration file (JSON)")
-
-	flag.Parse()
-
-	if *wgConfigPath != "" {
+	flags.StringVar(&cfg.ClientTunIP, "tc", "192.168.1.100/24", "client tun device ips, comma separated for dual-stack (e.g. 192.168.1.100/24,fd00::100/64)")
+	flags.StringVar(&cfg.ServerTunIP, "ts", "192.168.1.102/24", "server tun device ips, comma separated for dual-stack")
+	flags.StringVar(&cfg.ServerAddress, "s", "138.197.32.138:3000", "server address, or a comma separated list of servers to fail over between")
+	flags.StringVar(&cfg.LocalAddress, "l", "3000", "local address")
+	flags.StringVar(&cfg.TunName, "tname", "tun0", "tun interface name")
+	flags.BoolVar(&cfg.Global, "g", false, "global")
+	flags.Func("d", "comma separated destination hosts/networks to route through the VPN (default 10.108.0.2)", func(value string) error {
+		cfg.Routes = utils.SplitAddressList(value)
+		return nil
+	})
+	flags.Func("x", "comma separated hosts/networks to keep off the VPN, carved out of -d and -g", func(value string) error {
+		cfg.ExcludedRoutes = utils.SplitAddressList(value)
+		return nil
+	})
+	routesPath := flags.String("routes", "", "path to a split tunnel route file (JSON) with include and exclude lists")
+	flags.IntVar(&cfg.RouteTable, "table", 0, "routing table for tunnel routes, selected by policy rules (default: main table)")
+	flags.IntVar(&cfg.FwMark, "fwmark", 51820, "fwmark on tunnel traffic that bypasses the -table policy rules")
+	flags.BoolVar(&cfg.KillSwitch, "killswitch", false, "block all traffic outside the tunnel while the client runs")
+	flags.BoolVar(&cfg.ServerMode, "srv", false, "server mode")
+	flags.StringVar(&cfg.NATInterface, "nat", "", "enable forwarding and masquerade client traffic out of this interface (server mode)")
+	flags.DurationVar(&cfg.SessionTimeout, "idle", 3*time.Minute, "drop client sessions idle for longer than this (server mode)")
+	flags.StringVar(&cfg.ClientPool, "pool", "", "CIDRs to lease client tunnel addresses from, one per address family (server mode)")
+	flags.StringVar(&cfg.LeaseFile, "leases", "", "file to persist client address leases in (server mode)")
+	flags.DurationVar(&cfg.LeaseTime, "lease-time", 30*24*time.Hour, "reclaim the addresses of clients gone for longer than this, 0 never does (server mode)")
+	flags.StringVar(&cfg.ClientID, "id", hostname, "client id announced to the server")
+	flags.Func("allow", "comma separated client ids allowed to connect (server mode, default all)", func(value string) error {
+		cfg.AllowedClients = utils.SplitAddressList(value)
+		return nil
+	})
+	flags.Func("dns", "comma separated DNS servers to advertise to clients (server mode) or to use while connected", func(value string) error {
+		cfg.DNSServers = utils.SplitAddressList(value)
+		return nil
+	})
+	flags.Func("search", "comma separated DNS search domains to advertise to clients (server mode) or to use while connected", func(value string) error {
+		cfg.SearchDomains = utils.SplitAddressList(value)
+		return nil
+	})
+	flags.Func("dns-forward", "comma separated domain=resolver rules for a split DNS forwarder on the tunnel address (e.g. internal=10.108.0.53)", func(value string) error {
+		cfg.DNSForward = utils.SplitAddressList(value)
+		return nil
+	})
+	flags.Func("mtu", "tun device MTU, or auto to derive it from the egress interface minus the tunnel overhead (default 1500)", func(value string) error {
+		if value == "auto" {
+			cfg.MTU = 0
+			return nil
+		}
+		mtu, err := strconv.Atoi(value)
+		cfg.MTU = mtu
+		return err
+	})
+	flags.DurationVar(&cfg.KeepaliveInterval, "keepalive", 10*time.Second, "keepalive interval clients are asked to use (server mode)")
+	flags.StringVar(&cfg.PreSharedKeyFile, "psk", "", "path to a base64 pre-shared key file to encrypt plain transport traffic")
+	flags.StringVar(&cfg.LogFile, "log-file", "", "append logs to this file instead of stderr")
+	flags.StringVar(&cfg.ControlSocket, "control", control.DefaultSocket, "Unix socket for safehaven commands such as status, empty to disable")
+	flags.StringVar(&cfg.MetricsAddress, "metrics", "", "address to serve expvar metrics on at /debug/vars (e.g. 127.0.0.1:9100)")
+	configPath := flags.String("c", "", "path to a configuration file (JSON), flags given on the command line override it")
+	wgConfigPath := flags.String("wg", "", "path to WireGuard configuration file, JSON keys or a wg-quick .conf file")
+
+	flags.Usage = func() {
+		printUsage()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	defaultRoutes := true
+	if *configPath != "" {
+		file, err := config.LoadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := file.Apply(cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", *configPath, err)
+		}
+		if file.Routes.Include != nil {
+			defaultRoutes = false
+		}
+		if file.Transport.Type == "wireguard" {
+			*wgConfigPath = file.Transport.WireGuardConfig
+		}
+	}
+	if wg.IsQuickConfig(*wgConfigPath) {
+		quick, err := wg.LoadQuickConfig(*wgConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load wg config: %w", err)
+		}
+		if err := cfg.ApplyQuick(quick); err != nil {
+			return nil, fmt.Errorf("invalid wg config %s: %w", *wgConfigPath, err)
+		}
+		defaultRoutes = false
+	}
+	if *configPath != "" || wg.IsQuickConfig(*wgConfigPath) {
+		// Parse again so that flags given on the command line override the files
+		flags.Parse(args)
+	}
+
+	// The default destination only applies when nothing else says otherwise
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "d" {
+			defaultRoutes = false
+		}
+	})
+	if *routesPath != "" {
+		routes, err := config.LoadRouteList(*routesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load route file: %w", err)
+		}
+		if defaultRoutes {
+			cfg.Routes = nil
+		}
+		cfg.Routes = append(cfg.Routes, routes.Include...)
+		cfg.ExcludedRoutes = append(cfg.ExcludedRoutes, routes.Exclude...)
+	}
+
+	if *wgConfigPath != "" && cfg.WireGuardConfig == nil {
 		wgConfig, err := wg.LoadWireGuardConfig(*wgConfigPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load wg config: %w", err)
@@ -40,21 +152,78 @@ func setupConfig() (*config.Config, error) {
 		cfg.WireGuardConfig = wgConfig
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// serveMetrics exposes the expvar metrics published by the VPN service over HTTP
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Printf("Serving metrics on http://%s/debug/vars", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("Error serving metrics: %v", err)
+	}
+}
+
+// reload re-reads the configuration and hands it to the VPN service to apply in place. A
+// configuration that fails to load or validate is ignored and the old one kept.
+func reload(vpnService vpn.VPNService) {
+	log.Println("Received SIGHUP: reloading configuration")
+	reloader, ok := vpnService.(vpn.Reloader)
+	if !ok {
+		log.Println("VPN service does not support reloading, ignoring SIGHUP")
+		return
+	}
+	cfg, err := setupConfig(os.Args[1:])
+	if err != nil {
+		log.Printf("Keeping the current configuration: %v", err)
+		return
+	}
+	if err := reloader.Reload(cfg); err != nil {
+		log.Printf("Error reloading configuration: %v", err)
+		return
+	}
+	log.Println("Configuration reloaded")
+}
+
 func main() {
-	cfg, err := setupConfig()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	cfg, err := setupConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if cfg.LogFile != "" {
+		logFile, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+	if cfg.MetricsAddress != "" {
+		go serveMetrics(cfg.MetricsAddress)
+	}
+
 	var vpnService vpn.VPNService
 	if cfg.WireGuardConfig != nil {
 		vpnService = wg2.NewWireGuardVPN(cfg)
 	} else {
 		vpnService = plain.NewPlainVPN(cfg)
 	}
+	if admin, ok := vpnService.(control.Admin); ok && cfg.ControlSocket != "" {
+		controlServer, err := control.Listen(cfg.ControlSocket, admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer controlServer.Close()
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
@@ -64,9 +233,15 @@ func main() {
 	)
 
 	ctx, cancel := context.WithCancel(context.Background())
+	shutdownDone := make(chan struct{})
 
 	go func() {
+		defer close(shutdownDone)
 		sig := <-signalChan
+		for sig == syscall.SIGHUP {
+			reload(vpnService)
+			sig = <-signalChan
+		}
 		log.Printf("Received signal %v: initiating graceful shutdown", sig)
 
 		cancel()
@@ -90,12 +265,13 @@ func main() {
 		case <-stopDone:
 			log.Printf("VPN service stopped successfully")
 		}
-
-		os.Exit(0)
 	}()
 
 	// Start VPN service
 	if err := vpnService.Start(ctx); err != nil {
 		log.Fatalf("Failed to start VPN service: %v", err)
 	}
+
+	// Start returns as soon as shutdown begins, so wait for Stop to revert the network changes
+	<-shutdownDone
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetupConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, "safehaven.json", `{
+		"mode": "server",
+		"listen_port": "4000",
+		"tunnel": {"name": "tun7", "server_ips": ["10.108.0.1/24"], "mtu": 1400},
+		"pool": {"cidrs": ["10.108.0.0/24"], "idle_timeout": "5m"},
+		"dns": {"servers": ["10.108.0.53"]}
+	}`)
+	cfg, err := setupConfig([]string{"-c", path, "-l", "5000", "-dns", "1.1.1.1, 9.9.9.9", "-control", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.ServerMode || cfg.TunName != "tun7" || cfg.MTU != 1400 || cfg.ClientPool != "10.108.0.0/24" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if cfg.SessionTimeout != 5*time.Minute {
+		t.Errorf("idle timeout %s, want 5m from the file", cfg.SessionTimeout)
+	}
+	if cfg.LocalAddress != "5000" {
+		t.Errorf("listen port %s, want 5000 from the command line", cfg.LocalAddress)
+	}
+	if want := []string{"1.1.1.1", "9.9.9.9"}; !reflect.DeepEqual(cfg.DNSServers, want) {
+		t.Errorf("DNS servers %v, want %v from the command line", cfg.DNSServers, want)
+	}
+	if cfg.KeepaliveInterval != 10*time.Second {
+		t.Errorf("keepalive %s, want the 10s flag default", cfg.KeepaliveInterval)
+	}
+}
+
+func TestSetupConfigRoutes(t *testing.T) {
+	routeFile := writeConfig(t, "routes.json", `{"include": ["172.16.0.0/12"], "exclude": ["172.16.1.0/24"]}`)
+	configFile := writeConfig(t, "safehaven.json", `{"routes": {"include": ["192.168.0.0/16"]}}`)
+	tests := []struct {
+		name    string
+		args    []string
+		routes  []string
+		exclude []string
+	}{
+		{
+			name:   "default destination",
+			args:   nil,
+			routes: []string{"10.108.0.2"},
+		},
+		{
+			name:   "destinations on the command line",
+			args:   []string{"-d", "10.0.0.0/8, 1.1.1.1"},
+			routes: []string{"10.0.0.0/8", "1.1.1.1"},
+		},
+		{
+			name:    "route file replaces the default",
+			args:    []string{"-routes", routeFile},
+			routes:  []string{"172.16.0.0/12"},
+			exclude: []string{"172.16.1.0/24"},
+		},
+		{
+			name:    "route file adds to the command line",
+			args:    []string{"-d", "10.0.0.0/8", "-routes", routeFile},
+			routes:  []string{"10.0.0.0/8", "172.16.0.0/12"},
+			exclude: []string{"172.16.1.0/24"},
+		},
+		{
+			name:   "config file replaces the default",
+			args:   []string{"-c", configFile},
+			routes: []string{"192.168.0.0/16"},
+		},
+		{
+			name:   "command line overrides the config file",
+			args:   []string{"-c", configFile, "-d", "10.0.0.0/8"},
+			routes: []string{"10.0.0.0/8"},
+		},
+	}
+	for _, test := range tests {
+		cfg, err := setupConfig(test.args)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Routes, test.routes) || !reflect.DeepEqual(cfg.ExcludedRoutes, test.exclude) {
+			t.Errorf("%s: got routes %v excluding %v, want %v excluding %v", test.name, cfg.Routes, cfg.ExcludedRoutes, test.routes, test.exclude)
+		}
+	}
+}
+
+func TestSetupConfigInvalid(t *testing.T) {
+	path := writeConfig(t, "safehaven.json", `{"mode": "server", "tunnel": {"mtu": 100}}`)
+	if _, err := setupConfig([]string{"-c", path}); err == nil {
+		t.Error("invalid configuration accepted")
+	}
+	if _, err := setupConfig([]string{"-c", writeConfig(t, "typo.json", `{"tunel": {}}`)}); err == nil {
+		t.Error("unknown config file field accepted")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/kwakubiney/safehaven/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func peer(args []string) error {
+	if len(args) == 0 || args[0] != "add" {
+		return errors.New("usage: peer add -c <server config> -id <id> -ip <tunnel ip> -endpoint <host:port>")
+	}
+	return peerAdd(args[1:])
+}
+
+// peerAdd generates a key pair for a new peer, appends the peer to the server's config file
+// and prints a wg-quick config for the client. The private key only ever goes to stdout.
+func peerAdd(args []string) error {
+	flags := flag.NewFlagSet("peer add", flag.ExitOnError)
+	configPath := flags.String("c", "", "server configuration file (JSON) to add the peer to")
+	id := flags.String("id", "", "id of the new peer")
+	tunnelIP := flags.String("ip", "", "tunnel address of the new peer")
+	endpoint := flags.String("endpoint", "", "public host:port clients reach the server on")
+	allowedIPs := flags.String("allowed", "", "comma separated networks the client routes through the tunnel (default: the server's tunnel networks)")
+	withPresharedKey := flags.Bool("psk", false, "generate a preshared key for the peer")
+	keepalive := flags.Int("keepalive", 25, "persistent keepalive interval in seconds the client uses, 0 to turn it off")
+	flags.Parse(args)
+	if *configPath == "" || *id == "" || *tunnelIP == "" || *endpoint == "" {
+		return errors.New("-c, -id, -ip and -endpoint are required")
+	}
+
+	file, err := config.LoadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	if file.Transport.Type != "wireguard" {
+		return fmt.Errorf("%s does not use the wireguard transport", *configPath)
+	}
+	serverKey, err := serverPublicKey(file.Transport.WireGuardConfig)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(*tunnelIP)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel address: %w", err)
+	}
+	for _, existing := range file.Peers {
+		if existing.ID == *id {
+			return fmt.Errorf("peer %s already exists", *id)
+		}
+		for _, ip := range existing.TunnelIPs {
+			if taken, err := netip.ParseAddr(utils.RemoveCIDRSuffix(ip, "/")); err == nil && taken.Unmap() == addr.Unmap() {
+				return fmt.Errorf("tunnel address %s is taken by peer %s", addr, existing.ID)
+			}
+		}
+	}
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	newPeer := config.Peer{
+		ID:        *id,
+		TunnelIPs: []string{addr.String()},
+		PublicKey: privateKey.PublicKey().String(),
+	}
+	if *withPresharedKey {
+		presharedKey, err := wgtypes.GenerateKey()
+		if err != nil {
+			return err
+		}
+		newPeer.PresharedKey = presharedKey.String()
+		if err := wg.CheckPrivateFile(*configPath); err != nil {
+			return err
+		}
+	}
+	peers := append(file.Peers, newPeer)
+	if err := writePeers(*configPath, peers); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added peer %s to %s, send SIGHUP to the server to apply it\n", *id, *configPath)
+
+	routes := *allowedIPs
+	if routes == "" {
+		routes = serverNetworks(file.Tunnel.ServerIPs)
+	}
+	fmt.Printf("# SafeHaven client config for %s, run with: safehaven -wg %s.conf\n", *id, *id)
+	fmt.Println("[Interface]")
+	fmt.Printf("PrivateKey = %s\n", privateKey)
+	fmt.Printf("Address = %s\n", netip.PrefixFrom(addr, addr.BitLen()))
+	if len(file.DNS.Servers) > 0 {
+		fmt.Printf("DNS = %s\n", strings.Join(file.DNS.Servers, ", "))
+	}
+	fmt.Println()
+	fmt.Println("[Peer]")
+	fmt.Printf("PublicKey = %s\n", serverKey)
+	if newPeer.PresharedKey != "" {
+		fmt.Printf("PresharedKey = %s\n", newPeer.PresharedKey)
+	}
+	fmt.Printf("AllowedIPs = %s\n", routes)
+	fmt.Printf("Endpoint = %s\n", *endpoint)
+	if *keepalive != 0 {
+		fmt.Printf("PersistentKeepalive = %d\n", *keepalive)
+	}
+	return nil
+}
+
+// serverPublicKey derives the server's public key from its WireGuard config file
+func serverPublicKey(wgConfigPath string) (wgtypes.Key, error) {
+	var privateKey string
+	if wg.IsQuickConfig(wgConfigPath) {
+		quick, err := wg.LoadQuickConfig(wgConfigPath)
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		privateKey = quick.Interface.PrivateKey
+	} else {
+		wgConfig, err := wg.LoadWireGuardConfig(wgConfigPath)
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		privateKey = wgConfig.OwnPrivateKey(true)
+	}
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid server private key: %w", err)
+	}
+	return key.PublicKey(), nil
+}
+
+// serverNetworks are the networks of the server's tunnel addresses, or everything if it has none
+func serverNetworks(serverIPs []string) string {
+	var networks []string
+	for _, serverIP := range serverIPs {
+		if prefix, err := netip.ParsePrefix(serverIP); err == nil {
+			networks = append(networks, prefix.Masked().String())
+		}
+	}
+	if len(networks) == 0 {
+		return "0.0.0.0/0, ::/0"
+	}
+	return strings.Join(networks, ", ")
+}
+
+// writePeers replaces the peers in the config file, leaving the rest of the file as it was
+// written. The file is replaced atomically so a running server never reads half of it.
+func writePeers(configPath string, peers []config.Peer) error {
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	contents, err = replaceMember(contents, "peers", peers)
+	if err != nil {
+		return fmt.Errorf("failed to update config file %s: %w", configPath, err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// replaceMember sets the member name of the JSON object in contents to value, touching nothing
+// else. The value is indented like the other members, and added at the end if it is missing.
+func replaceMember(contents []byte, name string, value interface{}) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("expected a JSON object")
+	}
+	indent := ""
+	for first := true; decoder.More(); first = false {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			keyEnd := int(decoder.InputOffset())
+			line := contents[bytes.LastIndexByte(contents[:keyEnd], '\n')+1 : keyEnd]
+			indent = string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+		}
+		var member json.RawMessage
+		if err := decoder.Decode(&member); err != nil {
+			return nil, err
+		}
+		if token != name {
+			continue
+		}
+		encoded, err := marshalMember(value, indent)
+		if err != nil {
+			return nil, err
+		}
+		end := int(decoder.InputOffset())
+		start := end - len(member)
+		return append(append(append([]byte{}, contents[:start]...), encoded...), contents[end:]...), nil
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	encoded, err := marshalMember(value, indent)
+	if err != nil {
+		return nil, err
+	}
+	closing := int(decoder.InputOffset()) - 1
+	last := len(bytes.TrimRight(contents[:closing], " \t\r\n"))
+	var member bytes.Buffer
+	if contents[last-1] != '{' {
+		member.WriteByte(',')
+	}
+	if indent == "" {
+		fmt.Fprintf(&member, "%q:%s", name, encoded)
+	} else {
+		fmt.Fprintf(&member, "\n%s%q: %s\n", indent, name, encoded)
+	}
+	return append(append(append([]byte{}, contents[:last]...), member.Bytes()...), contents[closing:]...), nil
+}
+
+// marshalMember encodes a member value nested at indent, or compactly when the file is compact
+func marshalMember(value interface{}, indent string) ([]byte, error) {
+	if indent == "" {
+		return json.Marshal(value)
+	}
+	return json.MarshalIndent(value, indent, indent)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/kwakubiney/safehaven/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serverConfig writes a wireguard server config file with one peer and returns its path and
+// the server's public key
+func serverConfig(t *testing.T) (string, wgtypes.Key) {
+	t.Helper()
+	dir := t.TempDir()
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "wg.json")
+	if err := os.WriteFile(keyFile, []byte(`{"private_key": "`+privateKey.String()+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "server.json")
+	contents := `{
+  "mode": "server",
+  "tunnel": {
+    "server_ips": ["10.108.0.1/24"]
+  },
+  "peers": [
+    {"id": "desktop", "tunnel_ips": ["10.108.0.2/24"], "public_key": "` + privateKey.PublicKey().String() + `"}
+  ],
+  "transport": {"type": "wireguard", "wireguard_config": "` + keyFile + `"}
+}
+`
+	if err := os.WriteFile(configFile, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile, privateKey.PublicKey()
+}
+
+func TestPeerAdd(t *testing.T) {
+	configFile, serverKey := serverConfig(t)
+	printed, err := capture(t, peer, []string{"add", "-c", configFile, "-id", "laptop", "-ip", "10.108.0.3", "-endpoint", "vpn.example.com:51820"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quick := map[string]string{}
+	for _, line := range strings.Split(printed, "\n") {
+		if key, value, found := strings.Cut(line, " = "); found {
+			quick[key] = value
+		}
+	}
+	privateKey, err := wgtypes.ParseKey(quick["PrivateKey"])
+	if err != nil {
+		t.Fatalf("no private key in %q", printed)
+	}
+	want := map[string]string{
+		"PrivateKey":          privateKey.String(),
+		"Address":             "10.108.0.3/32",
+		"PublicKey":           serverKey.String(),
+		"AllowedIPs":          "10.108.0.0/24",
+		"Endpoint":            "vpn.example.com:51820",
+		"PersistentKeepalive": "25",
+	}
+	for key, value := range want {
+		if quick[key] != value {
+			t.Errorf("%s = %q, want %q", key, quick[key], value)
+		}
+	}
+
+	file, err := config.LoadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Peers) != 2 || file.Peers[0].ID != "desktop" {
+		t.Fatalf("peers %+v", file.Peers)
+	}
+	added := file.Peers[1]
+	if added.ID != "laptop" || added.PublicKey != privateKey.PublicKey().String() || len(added.TunnelIPs) != 1 || added.TunnelIPs[0] != "10.108.0.3" {
+		t.Errorf("added %+v", added)
+	}
+	if strings.Contains(printed, "PresharedKey") || added.PresharedKey != "" {
+		t.Error("preshared key generated without -psk")
+	}
+}
+
+func TestPeerAddRefuses(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"existing id", []string{"-id", "desktop", "-ip", "10.108.0.3"}},
+		{"taken tunnel address", []string{"-id", "laptop", "-ip", "10.108.0.2"}},
+		{"invalid tunnel address", []string{"-id", "laptop", "-ip", "10.108.0"}},
+	}
+	for _, test := range tests {
+		configFile, _ := serverConfig(t)
+		before, _ := os.ReadFile(configFile)
+		args := append([]string{"add", "-c", configFile, "-endpoint", "vpn.example.com:51820"}, test.args...)
+		if _, err := capture(t, peer, args, ""); err == nil {
+			t.Errorf("%s: peer added", test.name)
+		}
+		if after, _ := os.ReadFile(configFile); string(after) != string(before) {
+			t.Errorf("%s: config file changed", test.name)
+		}
+	}
+}
+
+func TestWritePeersKeepsLayout(t *testing.T) {
+	peers := []config.Peer{{ID: "laptop", TunnelIPs: []string{"10.108.0.3"}}}
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{
+			name:     "peers replaced",
+			contents: "{\n  \"mode\": \"server\",\n  \"peers\": [],\n  \"listen_port\": \"3000\"\n}\n",
+			want:     "{\n  \"mode\": \"server\",\n  \"peers\": [\n    {\n      \"id\": \"laptop\",\n      \"tunnel_ips\": [\n        \"10.108.0.3\"\n      ]\n    }\n  ],\n  \"listen_port\": \"3000\"\n}\n",
+		},
+		{
+			name:     "peers added",
+			contents: "{\n    \"mode\": \"server\"\n}\n",
+			want:     "{\n    \"mode\": \"server\",\n    \"peers\": [\n        {\n            \"id\": \"laptop\",\n            \"tunnel_ips\": [\n                \"10.108.0.3\"\n            ]\n        }\n    ]\n}\n",
+		},
+		{
+			name:     "compact file",
+			contents: `{"mode":"server"}`,
+			want:     `{"mode":"server","peers":[{"id":"laptop","tunnel_ips":["10.108.0.3"]}]}`,
+		},
+		{
+			name:     "empty object",
+			contents: `{}`,
+			want:     `{"peers":[{"id":"laptop","tunnel_ips":["10.108.0.3"]}]}`,
+		},
+	}
+	for _, test := range tests {
+		path := writeConfig(t, "server.json", test.contents)
+		if err := writePeers(path, peers); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got, _ := os.ReadFile(path); string(got) != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
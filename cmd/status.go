@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"os"
+	"strings"
+	"time"
+)
+
+// status prints the state of the running daemon, much like wg show
+func status(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := flags.String("control", control.DefaultSocket, "control socket of the daemon")
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	flags.Parse(args)
+
+	current, err := control.NewClient(*socket).Status()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(current)
+	}
+
+	fmt.Printf("interface: %s (%s %s)\n", current.Interface, current.Transport, current.Mode)
+	if current.PublicKey != "" {
+		fmt.Printf("  public key: %s\n", current.PublicKey)
+	}
+	if current.ListenPort != 0 {
+		fmt.Printf("  listening port: %d\n", current.ListenPort)
+	}
+	for _, peer := range current.Peers {
+		fmt.Println()
+		switch {
+		case peer.PublicKey != "" && peer.ID != "":
+			fmt.Printf("peer: %s (%s)\n", peer.PublicKey, peer.ID)
+		case peer.PublicKey != "":
+			fmt.Printf("peer: %s\n", peer.PublicKey)
+		default:
+			fmt.Printf("peer: %s\n", peer.ID)
+		}
+		if peer.Endpoint != "" {
+			fmt.Printf("  endpoint: %s\n", peer.Endpoint)
+		}
+		fmt.Printf("  allowed ips: %s\n", strings.Join(peer.AllowedIPs, ", "))
+		if current.Transport == "wireguard" {
+			if peer.LatestHandshake != nil {
+				fmt.Printf("  latest handshake: %s ago\n", time.Since(*peer.LatestHandshake).Round(time.Second))
+			} else {
+				fmt.Println("  latest handshake: never")
+			}
+			fmt.Printf("  transfer: %s received, %s sent\n", formatBytes(peer.RxBytes), formatBytes(peer.TxBytes))
+		}
+		if peer.LastSeen != nil {
+			fmt.Printf("  last seen: %s ago\n", time.Since(*peer.LastSeen).Round(time.Second))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Printf("  persistent keepalive: every %d seconds\n", peer.PersistentKeepalive)
+		}
+	}
+	return nil
+}
+
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
+
+func route(args []string) error {
+	flags := flag.NewFlagSet("route", flag.ExitOnError)
+	socket := flags.String("control", control.DefaultSocket, "control socket of the daemon")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: route add|del <destination>")
+	}
+
+	client := control.NewClient(*socket)
+	switch action, dst := flags.Arg(0), flags.Arg(1); action {
+	case "add":
+		return client.AddRoute(dst)
+	case "del":
+		return client.RemoveRoute(dst)
+	default:
+		return fmt.Errorf("unknown action %q, expected add or del", action)
+	}
+}
+
+func reconnect(args []string) error {
+	flags := flag.NewFlagSet("reconnect", flag.ExitOnError)
+	socket := flags.String("control", control.DefaultSocket, "control socket of the daemon")
+	flags.Parse(args)
+	return control.NewClient(*socket).Reconnect()
+}
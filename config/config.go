@@ -1,16 +1,65 @@
 package config
 
-import "github.com/kwakubiney/safehaven/wg"
+import (
+	"github.com/kwakubiney/safehaven/wg"
+	"time"
+)
 
 type Config struct {
-	ClientTunIP        string
-	ServerAddress      string
-	ServerPort         string
-	TunName            string
-	ServerTunIP        string
-	LocalAddress       string
-	DestinationAddress string
-	WireGuardConfig    *wg.WireGuardConfig
-	Global             bool
-	ServerMode         bool
+	ClientTunIP     string
+	ServerAddress   string
+	ServerPort      string
+	TunName         string
+	ServerTunIP     string
+	LocalAddress    string
+	WireGuardConfig *wg.WireGuardConfig
+	Global          bool
+	ServerMode      bool
+	SessionTimeout  time.Duration
+	ClientPool      string
+	LeaseFile       string
+	// LeaseTime is how long a pool address stays leased to a client that went away
+	LeaseTime      time.Duration
+	ClientID       string
+	AllowedClients []string
+	// MTU of the TUN device, 0 derives it from the egress interface
+	MTU               int
+	KeepaliveInterval time.Duration
+	PreSharedKeyFile  string
+	// Routes are sent through the tunnel by the client, minus ExcludedRoutes
+	Routes         []string
+	ExcludedRoutes []string
+	// RouteTable holds the client routes instead of the main table when set, selected by
+	// policy rules for all traffic not carrying FwMark
+	RouteTable int
+	FwMark     int
+	KillSwitch bool
+	// NATInterface is the egress interface client traffic is masqueraded out of in server mode
+	NATInterface string
+	// DNSServers and SearchDomains are advertised to clients in server mode and override
+	// whatever the server advertises in client mode
+	DNSServers    []string
+	SearchDomains []string
+	// DNSForward holds domain=resolver rules for the client's split DNS forwarder
+	DNSForward []string
+	// Peers are the clients a server knows up front, with the tunnel addresses reserved for them
+	Peers          []Peer
+	LogFile        string
+	MetricsAddress string
+	// ControlSocket is the Unix socket safehaven commands such as status talk to the daemon on
+	ControlSocket string
+}
+
+// Peer is a client known to the server ahead of time. The WireGuard fields are only used by
+// the WireGuard transport.
+type Peer struct {
+	ID        string   `json:"id"`
+	TunnelIPs []string `json:"tunnel_ips"`
+	// PublicKey and PresharedKey are base64 encoded WireGuard keys
+	PublicKey    string `json:"public_key,omitempty"`
+	PresharedKey string `json:"preshared_key,omitempty"`
+	// AllowedIPs default to the peer's tunnel addresses
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// PersistentKeepalive is the keepalive interval in seconds, 0 disables it
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
 }
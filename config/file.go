@@ -0,0 +1,233 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kwakubiney/safehaven/wg"
+	"os"
+	"strings"
+	"time"
+)
+
+// File is the JSON configuration file. Every field is optional, anything left out keeps its
+// flag default, and flags given on the command line override the file.
+type File struct {
+	// Mode is "client" or "server"
+	Mode         string           `json:"mode"`
+	ClientID     string           `json:"client_id"`
+	Tunnel       TunnelSection    `json:"tunnel"`
+	Servers      []string         `json:"servers"`
+	ListenPort   string           `json:"listen_port"`
+	Routes       RoutesSection    `json:"routes"`
+	KillSwitch   *bool            `json:"kill_switch"`
+	NATInterface string           `json:"nat_interface"`
+	DNS          DNSSection       `json:"dns"`
+	Pool         PoolSection      `json:"pool"`
+	Peers        []Peer           `json:"peers"`
+	Transport    TransportSection `json:"transport"`
+	Logging      LoggingSection   `json:"logging"`
+	Metrics      MetricsSection   `json:"metrics"`
+	Control      ControlSection   `json:"control"`
+}
+
+type TunnelSection struct {
+	Name      string   `json:"name"`
+	ClientIPs []string `json:"client_ips"`
+	ServerIPs []string `json:"server_ips"`
+	MTU       MTU      `json:"mtu"`
+}
+
+type RoutesSection struct {
+	Global  *bool    `json:"global"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	Table   int      `json:"table"`
+	FwMark  int      `json:"fwmark"`
+}
+
+type DNSSection struct {
+	Servers       []string `json:"servers"`
+	SearchDomains []string `json:"search_domains"`
+	Forward       []string `json:"forward"`
+}
+
+type PoolSection struct {
+	CIDRs          []string `json:"cidrs"`
+	LeaseFile      string   `json:"lease_file"`
+	LeaseTime      Duration `json:"lease_time"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+	AllowedClients []string `json:"allowed_clients"`
+}
+
+type TransportSection struct {
+	// Type is "plain" or "wireguard"
+	Type              string   `json:"type"`
+	PreSharedKeyFile  string   `json:"psk_file"`
+	KeepaliveInterval Duration `json:"keepalive_interval"`
+	// WireGuardConfig is the path to the WireGuard key file, required with the wireguard type
+	WireGuardConfig string `json:"wireguard_config"`
+}
+
+type LoggingSection struct {
+	File string `json:"file"`
+}
+
+type MetricsSection struct {
+	Listen string `json:"listen"`
+}
+
+type ControlSection struct {
+	Socket string `json:"socket"`
+}
+
+// Duration is a time.Duration written as a string such as "3m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MTU is a number, or "auto" to derive it from the egress interface, in the config file
+type MTU struct {
+	Value int
+	Auto  bool
+}
+
+func (m *MTU) UnmarshalJSON(b []byte) error {
+	if string(b) == `"auto"` {
+		m.Auto = true
+		return nil
+	}
+	if err := json.Unmarshal(b, &m.Value); err != nil {
+		return fmt.Errorf("mtu must be a number or \"auto\": %w", err)
+	}
+	return nil
+}
+
+// LoadFile loads the configuration file, rejecting unknown fields so typos don't go unnoticed.
+// A file holding preshared keys must not be world-readable.
+func LoadFile(filepath string) (*File, error) {
+	file, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.DisallowUnknownFields()
+	var config File
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", filepath, err)
+	}
+	for _, peer := range config.Peers {
+		if peer.PresharedKey != "" {
+			if err := wg.CheckPrivateFile(filepath); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return &config, nil
+}
+
+// Apply copies every setting present in the file into c
+func (f *File) Apply(c *Config) error {
+	switch f.Mode {
+	case "":
+	case "client":
+		c.ServerMode = false
+	case "server":
+		c.ServerMode = true
+	default:
+		return fmt.Errorf("invalid mode %q, expected client or server", f.Mode)
+	}
+	switch f.Transport.Type {
+	case "", "plain", "wireguard":
+	default:
+		return fmt.Errorf("invalid transport type %q, expected plain or wireguard", f.Transport.Type)
+	}
+	if f.Transport.Type == "wireguard" && f.Transport.WireGuardConfig == "" {
+		return fmt.Errorf("the wireguard transport needs transport.wireguard_config")
+	}
+
+	setString(&c.ClientID, f.ClientID)
+	setString(&c.TunName, f.Tunnel.Name)
+	setString(&c.ClientTunIP, strings.Join(f.Tunnel.ClientIPs, ","))
+	setString(&c.ServerTunIP, strings.Join(f.Tunnel.ServerIPs, ","))
+	if f.Tunnel.MTU.Auto {
+		c.MTU = 0
+	} else {
+		setInt(&c.MTU, f.Tunnel.MTU.Value)
+	}
+	setString(&c.ServerAddress, strings.Join(f.Servers, ","))
+	setString(&c.LocalAddress, f.ListenPort)
+
+	setBool(&c.Global, f.Routes.Global)
+	setList(&c.Routes, f.Routes.Include)
+	setList(&c.ExcludedRoutes, f.Routes.Exclude)
+	setInt(&c.RouteTable, f.Routes.Table)
+	setInt(&c.FwMark, f.Routes.FwMark)
+	setBool(&c.KillSwitch, f.KillSwitch)
+	setString(&c.NATInterface, f.NATInterface)
+
+	setList(&c.DNSServers, f.DNS.Servers)
+	setList(&c.SearchDomains, f.DNS.SearchDomains)
+	setList(&c.DNSForward, f.DNS.Forward)
+
+	setString(&c.ClientPool, strings.Join(f.Pool.CIDRs, ","))
+	setString(&c.LeaseFile, f.Pool.LeaseFile)
+	setDuration(&c.LeaseTime, f.Pool.LeaseTime)
+	setDuration(&c.SessionTimeout, f.Pool.IdleTimeout)
+	setList(&c.AllowedClients, f.Pool.AllowedClients)
+	if f.Peers != nil {
+		c.Peers = f.Peers
+	}
+
+	setString(&c.PreSharedKeyFile, f.Transport.PreSharedKeyFile)
+	setDuration(&c.KeepaliveInterval, f.Transport.KeepaliveInterval)
+	setString(&c.LogFile, f.Logging.File)
+	setString(&c.MetricsAddress, f.Metrics.Listen)
+	setString(&c.ControlSocket, f.Control.Socket)
+	return nil
+}
+
+func setString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
+
+func setInt(dst *int, value int) {
+	if value != 0 {
+		*dst = value
+	}
+}
+
+func setBool(dst *bool, value *bool) {
+	if value != nil {
+		*dst = *value
+	}
+}
+
+func setList(dst *[]string, value []string) {
+	if value != nil {
+		*dst = value
+	}
+}
+
+func setDuration(dst *time.Duration, value Duration) {
+	if value.Duration != 0 {
+		*dst = value.Duration
+	}
+}
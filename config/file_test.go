@@ -0,0 +1,125 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApply(t *testing.T) {
+	path := writeFile(t, "server.json", `{
+		"mode": "server",
+		"tunnel": {"name": "sh0", "server_ips": ["10.108.0.1/24", "fd00::1/64"], "mtu": 1380},
+		"listen_port": "4000",
+		"routes": {"global": false, "table": 200, "fwmark": 51821},
+		"nat_interface": "eth0",
+		"dns": {"servers": ["10.108.0.53"], "search_domains": ["corp.internal"]},
+		"pool": {"cidrs": ["10.108.0.0/24"], "lease_file": "/var/lib/safehaven/leases.json", "lease_time": "24h", "idle_timeout": "5m", "allowed_clients": ["laptop"]},
+		"peers": [{"id": "laptop", "tunnel_ips": ["10.108.0.10"]}],
+		"transport": {"psk_file": "/etc/safehaven/psk", "keepalive_interval": "20s"},
+		"logging": {"file": "/var/log/safehaven.log"},
+		"metrics": {"listen": "127.0.0.1:9100"}
+	}`)
+	file, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flag defaults the file is applied over
+	cfg := &Config{TunName: "tun0", LocalAddress: "3000", Global: true, MTU: 1500, SessionTimeout: 3 * time.Minute, Routes: []string{"10.108.0.2"}}
+	if err := file.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Config{
+		ServerMode:        true,
+		TunName:           "sh0",
+		ServerTunIP:       "10.108.0.1/24,fd00::1/64",
+		MTU:               1380,
+		LocalAddress:      "4000",
+		Routes:            []string{"10.108.0.2"},
+		RouteTable:        200,
+		FwMark:            51821,
+		NATInterface:      "eth0",
+		DNSServers:        []string{"10.108.0.53"},
+		SearchDomains:     []string{"corp.internal"},
+		ClientPool:        "10.108.0.0/24",
+		LeaseFile:         "/var/lib/safehaven/leases.json",
+		LeaseTime:         24 * time.Hour,
+		SessionTimeout:    5 * time.Minute,
+		AllowedClients:    []string{"laptop"},
+		Peers:             []Peer{{ID: "laptop", TunnelIPs: []string{"10.108.0.10"}}},
+		PreSharedKeyFile:  "/etc/safehaven/psk",
+		KeepaliveInterval: 20 * time.Second,
+		LogFile:           "/var/log/safehaven.log",
+		MetricsAddress:    "127.0.0.1:9100",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got  %+v\nwant %+v", cfg, want)
+	}
+}
+
+func TestApplyKeepsDefaults(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "empty.json", `{"tunnel": {"mtu": "auto"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{TunName: "tun0", ServerMode: true, MTU: 1500, Routes: []string{"10.108.0.2"}}
+	if err := file.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{TunName: "tun0", ServerMode: true, MTU: 0, Routes: []string{"10.108.0.2"}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown field", `{"tunnel": {"nmae": "sh0"}}`, "unknown field"},
+		{"duration without unit", `{"pool": {"idle_timeout": "5"}}`, "missing unit"},
+		{"duration as number", `{"pool": {"idle_timeout": 300}}`, "duration must be a string"},
+		{"mtu as word", `{"tunnel": {"mtu": "big"}}`, "mtu must be a number"},
+		{"not json", `mode = server`, "failed to parse"},
+	}
+	for _, test := range tests {
+		_, err := LoadFile(writeFile(t, "config.json", test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file File
+	}{
+		{"unknown mode", File{Mode: "relay"}},
+		{"unknown transport", File{Transport: TransportSection{Type: "ipsec"}}},
+		{"wireguard without keys", File{Transport: TransportSection{Type: "wireguard"}}},
+	}
+	for _, test := range tests {
+		if err := test.file.Apply(&Config{}); err == nil {
+			t.Errorf("%s: applied", test.name)
+		}
+	}
+}
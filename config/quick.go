@@ -0,0 +1,78 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/kwakubiney/safehaven/wg"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ApplyQuick copies the settings of a wg-quick configuration into c. In client mode the
+// single [Peer] is the server: its endpoint becomes the server address and its allowed IPs
+// the routes through the tunnel, with a default route meaning global mode. In server mode
+// every [Peer] is added to the peers, and their endpoints are ignored as WireGuard learns them
+// from handshakes.
+func (c *Config) ApplyQuick(q *wg.QuickConfig) error {
+	wgConfig := &wg.WireGuardConfig{PrivateKey: q.Interface.PrivateKey}
+	if c.ServerMode {
+		setString(&c.ServerTunIP, strings.Join(q.Interface.Address, ","))
+		for i, peer := range q.Peers {
+			c.Peers = append(c.Peers, Peer{
+				ID:                  fmt.Sprintf("peer%d", i+1),
+				PublicKey:           peer.PublicKey,
+				PresharedKey:        peer.PresharedKey,
+				AllowedIPs:          peer.AllowedIPs,
+				PersistentKeepalive: peer.PersistentKeepalive,
+			})
+		}
+	} else {
+		if len(q.Peers) != 1 {
+			return fmt.Errorf("a client needs exactly one [Peer], the server, found %d", len(q.Peers))
+		}
+		server := q.Peers[0]
+		if server.Endpoint == "" {
+			return errors.New("the server [Peer] has no Endpoint")
+		}
+		wgConfig.ServerPublicKey = server.PublicKey
+		wgConfig.PresharedKey = server.PresharedKey
+		wgConfig.PersistentKeepalive = server.PersistentKeepalive
+		setString(&c.ClientTunIP, strings.Join(q.Interface.Address, ","))
+		c.ServerAddress = server.Endpoint
+
+		c.Routes = nil
+		for _, allowedIP := range server.AllowedIPs {
+			prefix, err := utils.ParsePrefix(allowedIP)
+			if err != nil {
+				return fmt.Errorf("invalid AllowedIPs entry %q: %w", allowedIP, err)
+			}
+			if ones, _ := prefix.Mask.Size(); ones == 0 {
+				c.Global = true
+				continue
+			}
+			c.Routes = append(c.Routes, allowedIP)
+		}
+	}
+
+	if q.Interface.ListenPort != 0 {
+		c.LocalAddress = strconv.Itoa(q.Interface.ListenPort)
+	}
+	setInt(&c.MTU, q.Interface.MTU)
+	setInt(&c.RouteTable, q.Interface.Table)
+	setInt(&c.FwMark, q.Interface.FwMark)
+	// wg-quick takes anything in DNS that is not an address as a search domain
+	var servers, searchDomains []string
+	for _, entry := range q.Interface.DNS {
+		if net.ParseIP(entry) != nil {
+			servers = append(servers, entry)
+		} else {
+			searchDomains = append(searchDomains, entry)
+		}
+	}
+	setList(&c.DNSServers, servers)
+	setList(&c.SearchDomains, searchDomains)
+	c.WireGuardConfig = wgConfig
+	return nil
+}
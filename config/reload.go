@@ -0,0 +1,59 @@
+package config
+
+import (
+	"reflect"
+)
+
+// Reload copies the settings that can change while the tunnel is up from next: allowed
+// clients, peers, routes, the DNS settings and keepalive interval handed to clients, and the
+// WireGuard peer configuration
+func (c *Config) Reload(next *Config) {
+	c.AllowedClients = next.AllowedClients
+	c.Peers = next.Peers
+	c.Routes = next.Routes
+	c.ExcludedRoutes = next.ExcludedRoutes
+	c.Global = next.Global
+	c.DNSServers = next.DNSServers
+	c.SearchDomains = next.SearchDomains
+	c.KeepaliveInterval = next.KeepaliveInterval
+	c.WireGuardConfig = next.WireGuardConfig
+}
+
+// RestartRequired lists the settings that differ in next but only take effect on a restart
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	check := func(setting string, differs bool) {
+		if differs {
+			changed = append(changed, setting)
+		}
+	}
+	check("mode", c.ServerMode != next.ServerMode)
+	check("transport", (c.WireGuardConfig == nil) != (next.WireGuardConfig == nil))
+	check("tunnel interface", c.TunName != next.TunName)
+	check("client tunnel addresses", c.ClientTunIP != next.ClientTunIP)
+	check("server tunnel addresses", c.ServerTunIP != next.ServerTunIP)
+	check("MTU", c.MTU != next.MTU)
+	check("servers", c.ServerAddress != next.ServerAddress)
+	check("listen port", c.LocalAddress != next.LocalAddress)
+	check("client id", c.ClientID != next.ClientID)
+	check("routing table", c.RouteTable != next.RouteTable || c.FwMark != next.FwMark)
+	check("kill switch", c.KillSwitch != next.KillSwitch)
+	check("NAT interface", c.NATInterface != next.NATInterface)
+	check("DNS forwarding", !reflect.DeepEqual(c.DNSForward, next.DNSForward))
+	check("client pool", c.ClientPool != next.ClientPool || c.LeaseFile != next.LeaseFile || c.LeaseTime != next.LeaseTime)
+	check("idle timeout", c.SessionTimeout != next.SessionTimeout)
+	check("pre-shared key file", c.PreSharedKeyFile != next.PreSharedKeyFile)
+	check("log file", c.LogFile != next.LogFile)
+	check("metrics address", c.MetricsAddress != next.MetricsAddress)
+	check("control socket", c.ControlSocket != next.ControlSocket)
+	if !c.ServerMode {
+		// Clients apply their DNS settings once when they connect
+		check("DNS servers", !reflect.DeepEqual(c.DNSServers, next.DNSServers) ||
+			!reflect.DeepEqual(c.SearchDomains, next.SearchDomains))
+	}
+	if c.WireGuardConfig != nil && next.WireGuardConfig != nil {
+		check("WireGuard private key",
+			c.WireGuardConfig.OwnPrivateKey(c.ServerMode) != next.WireGuardConfig.OwnPrivateKey(c.ServerMode))
+	}
+	return changed
+}
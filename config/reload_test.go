@@ -0,0 +1,94 @@
+package config
+
+import (
+	"github.com/kwakubiney/safehaven/wg"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	current := &Config{
+		TunName:        "tun0",
+		ServerTunIP:    "10.108.0.1/24",
+		AllowedClients: []string{"laptop"},
+		SessionTimeout: time.Minute,
+	}
+	next := &Config{
+		TunName:           "tun1",
+		ServerTunIP:       "10.109.0.1/24",
+		AllowedClients:    []string{"laptop", "phone"},
+		Peers:             []Peer{{ID: "desktop", TunnelIPs: []string{"10.108.0.2"}}},
+		Routes:            []string{"10.0.0.0/8"},
+		ExcludedRoutes:    []string{"10.1.0.0/16"},
+		Global:            true,
+		DNSServers:        []string{"10.108.0.53"},
+		SearchDomains:     []string{"corp.internal"},
+		KeepaliveInterval: 20 * time.Second,
+		SessionTimeout:    time.Hour,
+		WireGuardConfig:   &wg.WireGuardConfig{ClientPublicKey: "key"},
+	}
+	current.Reload(next)
+
+	want := *next
+	// Settings that need a restart keep their running values
+	want.TunName, want.ServerTunIP, want.SessionTimeout = "tun0", "10.108.0.1/24", time.Minute
+	if !reflect.DeepEqual(*current, want) {
+		t.Errorf("got %+v, want %+v", *current, want)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			TunName:       "tun0",
+			ClientTunIP:   "10.108.0.2/24",
+			ServerAddress: "vpn.example.com:3000",
+			Routes:        []string{"10.0.0.0/8"},
+			DNSServers:    []string{"10.108.0.53"},
+			MTU:           1500,
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"nothing changed", func(c *Config) {}, nil},
+		{"reloadable settings", func(c *Config) {
+			c.Routes = []string{"192.168.0.0/16"}
+			c.AllowedClients = []string{"laptop"}
+			c.KeepaliveInterval = time.Minute
+		}, nil},
+		{"tunnel", func(c *Config) { c.TunName, c.MTU = "tun1", 1400 }, []string{"tunnel interface", "MTU"}},
+		{"servers", func(c *Config) { c.ServerAddress = "vpn.example.com:3001" }, []string{"servers"}},
+		{"mode", func(c *Config) { c.ServerMode = true }, []string{"mode"}},
+		{"transport", func(c *Config) { c.WireGuardConfig = &wg.WireGuardConfig{} }, []string{"transport"}},
+		{"client DNS", func(c *Config) { c.SearchDomains = []string{"corp.internal"} }, []string{"DNS servers"}},
+		{"routing table", func(c *Config) { c.FwMark = 1 }, []string{"routing table"}},
+	}
+	for _, test := range tests {
+		next := base()
+		test.change(next)
+		if got := base().RestartRequired(next); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Servers hand their DNS settings to every new client, so no restart is needed
+	server, next := base(), base()
+	server.ServerMode, next.ServerMode = true, true
+	next.DNSServers = nil
+	if got := server.RestartRequired(next); got != nil {
+		t.Errorf("server DNS change: got %v", got)
+	}
+
+	withKey := func(key string) *Config {
+		c := base()
+		c.WireGuardConfig = &wg.WireGuardConfig{PrivateKey: key}
+		return c
+	}
+	if got := withKey("a").RestartRequired(withKey("b")); !reflect.DeepEqual(got, []string{"WireGuard private key"}) {
+		t.Errorf("private key change: got %v", got)
+	}
+}
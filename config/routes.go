@@ -0,0 +1,28 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RouteList is the split tunnel configuration: traffic for Include is sent through the
+// tunnel except for anything falling within Exclude
+type RouteList struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// LoadRouteList loads a split tunnel route list from a JSON file
+func LoadRouteList(filepath string) (*RouteList, error) {
+	file, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route file: %w", err)
+	}
+
+	var routes RouteList
+	if err := json.Unmarshal(file, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse route file: %w", err)
+	}
+	return &routes, nil
+}
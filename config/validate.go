@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/utils"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the whole configuration up front and reports every problem found, so a bad
+// config fails before any network changes are made
+func (c *Config) Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.TunName == "" {
+		fail("tunnel interface name is empty")
+	}
+	for _, tunnelIP := range utils.SplitAddressList(c.ClientTunIP) {
+		if _, err := netip.ParsePrefix(tunnelIP); err != nil {
+			fail("invalid client tunnel address %q, expected CIDR notation such as 192.168.1.100/24", tunnelIP)
+		}
+	}
+	for _, tunnelIP := range utils.SplitAddressList(c.ServerTunIP) {
+		if _, err := netip.ParsePrefix(tunnelIP); err != nil {
+			fail("invalid server tunnel address %q, expected CIDR notation such as 192.168.1.102/24", tunnelIP)
+		}
+	}
+	if c.MTU != 0 && (c.MTU < 576 || c.MTU > 65535) {
+		fail("MTU %d is outside 576-65535", c.MTU)
+	}
+
+	if c.ServerMode {
+		if port, err := strconv.Atoi(c.LocalAddress); err != nil || port < 1 || port > 65535 {
+			fail("invalid listen port %q", c.LocalAddress)
+		}
+		if c.SessionTimeout <= 0 {
+			fail("idle timeout must be positive")
+		}
+		if c.KeepaliveInterval < 0 {
+			fail("keepalive interval must not be negative")
+		}
+		if c.LeaseTime < 0 {
+			fail("lease time must not be negative")
+		}
+	} else {
+		servers := utils.SplitAddressList(c.ServerAddress)
+		if len(servers) == 0 {
+			fail("no server address given")
+		}
+		for _, server := range servers {
+			if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+				fail("invalid server address %q, expected host:port", server)
+			}
+		}
+		if len(c.Routes) == 0 && !c.Global {
+			fail("no routes given, use -d, a route file or global mode")
+		}
+	}
+
+	for _, route := range append(append([]string{}, c.Routes...), c.ExcludedRoutes...) {
+		if _, err := utils.ParsePrefix(route); err != nil {
+			fail("invalid route %q, expected an address or CIDR", route)
+		}
+	}
+	if c.RouteTable < 0 {
+		fail("invalid routing table %d", c.RouteTable)
+	}
+	if c.RouteTable != 0 && c.FwMark == 0 {
+		fail("a routing table needs a non-zero fwmark")
+	}
+
+	for _, server := range c.DNSServers {
+		if net.ParseIP(server) == nil {
+			fail("invalid DNS server %q, expected an IP address", server)
+		}
+	}
+	for _, rule := range c.DNSForward {
+		domain, resolver, found := strings.Cut(rule, "=")
+		if !found || strings.TrimSpace(domain) == "" || net.ParseIP(strings.TrimSpace(resolver)) == nil {
+			fail("invalid DNS forwarding rule %q, expected domain=resolver-ip", rule)
+		}
+	}
+
+	var pool []netip.Prefix
+	for _, cidr := range utils.SplitAddressList(c.ClientPool) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			fail("invalid client pool %q, expected CIDR notation", cidr)
+			continue
+		}
+		pool = append(pool, prefix.Masked())
+	}
+	seen := map[string]bool{}
+	for i, peer := range c.Peers {
+		if peer.ID == "" {
+			fail("peer %d has no id", i+1)
+		} else if seen[peer.ID] {
+			fail("peer %s is listed twice", peer.ID)
+		}
+		seen[peer.ID] = true
+		for _, tunnelIP := range peer.TunnelIPs {
+			addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+			if err != nil {
+				fail("invalid tunnel address %q for peer %s", tunnelIP, peer.ID)
+				continue
+			}
+			if len(pool) > 0 && !poolContains(pool, addr) {
+				fail("tunnel address %s of peer %s is outside the client pool", addr, peer.ID)
+			}
+		}
+	}
+	if c.WireGuardConfig != nil {
+		if _, err := wgtypes.ParseKey(c.WireGuardConfig.OwnPrivateKey(c.ServerMode)); err != nil {
+			fail("invalid or missing WireGuard private key")
+		}
+		if !c.ServerMode {
+			if _, err := wgtypes.ParseKey(c.WireGuardConfig.ServerPublicKey); err != nil {
+				fail("invalid or missing WireGuard server public key")
+			}
+		}
+		if c.WireGuardConfig.PresharedKey != "" {
+			if _, err := wgtypes.ParseKey(c.WireGuardConfig.PresharedKey); err != nil {
+				fail("invalid WireGuard preshared key")
+			}
+		}
+		if keepalive := c.WireGuardConfig.PersistentKeepalive; keepalive < 0 || keepalive > 65535 {
+			fail("WireGuard persistent keepalive is outside 0-65535 seconds")
+		}
+	}
+	if c.WireGuardConfig != nil && c.ServerMode {
+		keys := map[string]bool{}
+		for _, peer := range c.Peers {
+			if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+				fail("invalid or missing public key for peer %s", peer.ID)
+			} else if keys[peer.PublicKey] {
+				fail("public key of peer %s is used by another peer", peer.ID)
+			}
+			keys[peer.PublicKey] = true
+			if peer.PresharedKey != "" {
+				if _, err := wgtypes.ParseKey(peer.PresharedKey); err != nil {
+					fail("invalid preshared key for peer %s", peer.ID)
+				}
+			}
+			if len(peer.AllowedIPs) == 0 && len(peer.TunnelIPs) == 0 {
+				fail("peer %s needs tunnel IPs or allowed IPs", peer.ID)
+			}
+			for _, allowedIP := range peer.AllowedIPs {
+				if _, err := utils.ParsePrefix(allowedIP); err != nil {
+					fail("invalid allowed IP %q for peer %s", allowedIP, peer.ID)
+				}
+			}
+			if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+				fail("persistent keepalive of peer %s is outside 0-65535 seconds", peer.ID)
+			}
+		}
+	}
+	if c.ServerMode && len(c.Peers) > 0 && len(pool) == 0 && c.WireGuardConfig == nil {
+		fail("peers need a client pool to reserve their addresses in")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+func poolContains(pool []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range pool {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
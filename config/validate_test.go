@@ -0,0 +1,98 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func validClient() *Config {
+	return &Config{
+		TunName:       "tun0",
+		ClientTunIP:   "10.108.0.2/24,fd00::2/64",
+		ServerTunIP:   "10.108.0.1/24",
+		ServerAddress: "vpn.example.com:3000,203.0.113.7:3000",
+		Routes:        []string{"10.0.0.0/8", "192.168.1.1"},
+		MTU:           1500,
+		FwMark:        51820,
+	}
+}
+
+func validServer() *Config {
+	return &Config{
+		ServerMode:        true,
+		TunName:           "tun0",
+		ServerTunIP:       "10.108.0.1/24",
+		LocalAddress:      "3000",
+		SessionTimeout:    3 * time.Minute,
+		KeepaliveInterval: 10 * time.Second,
+		ClientPool:        "10.108.0.0/24",
+		Peers:             []Peer{{ID: "laptop", TunnelIPs: []string{"10.108.0.10"}}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validClient().Validate(); err != nil {
+		t.Errorf("client: %v", err)
+	}
+	if err := validServer().Validate(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+	global := validClient()
+	global.Routes, global.Global = nil, true
+	if err := global.Validate(); err != nil {
+		t.Errorf("global client: %v", err)
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    func() *Config
+		change func(c *Config)
+		want   string
+	}{
+		{"empty tunnel name", validClient, func(c *Config) { c.TunName = "" }, "tunnel interface name is empty"},
+		{"tunnel IP without prefix length", validClient, func(c *Config) { c.ClientTunIP = "10.108.0.2" }, `invalid client tunnel address "10.108.0.2"`},
+		{"MTU too small", validClient, func(c *Config) { c.MTU = 500 }, "MTU 500 is outside 576-65535"},
+		{"no server", validClient, func(c *Config) { c.ServerAddress = "" }, "no server address given"},
+		{"server without port", validClient, func(c *Config) { c.ServerAddress = "vpn.example.com" }, `invalid server address "vpn.example.com"`},
+		{"no routes", validClient, func(c *Config) { c.Routes = nil }, "no routes given"},
+		{"invalid exclusion", validClient, func(c *Config) { c.ExcludedRoutes = []string{"10.0.0.0/40"} }, `invalid route "10.0.0.0/40"`},
+		{"table without fwmark", validClient, func(c *Config) { c.RouteTable, c.FwMark = 200, 0 }, "a routing table needs a non-zero fwmark"},
+		{"DNS server name", validClient, func(c *Config) { c.DNSServers = []string{"dns.example.com"} }, `invalid DNS server "dns.example.com"`},
+		{"forwarding rule without resolver", validClient, func(c *Config) { c.DNSForward = []string{"corp.internal"} }, `invalid DNS forwarding rule "corp.internal"`},
+		{"listen port out of range", validServer, func(c *Config) { c.LocalAddress = "70000" }, `invalid listen port "70000"`},
+		{"no idle timeout", validServer, func(c *Config) { c.SessionTimeout = 0 }, "idle timeout must be positive"},
+		{"negative keepalive", validServer, func(c *Config) { c.KeepaliveInterval = -time.Second }, "keepalive interval must not be negative"},
+		{"invalid pool", validServer, func(c *Config) { c.ClientPool = "10.108.0.0" }, `invalid client pool "10.108.0.0"`},
+		{"peer without id", validServer, func(c *Config) { c.Peers[0].ID = "" }, "peer 1 has no id"},
+		{"peer listed twice", validServer, func(c *Config) { c.Peers = append(c.Peers, c.Peers[0]) }, "peer laptop is listed twice"},
+		{"peer outside the pool", validServer, func(c *Config) { c.Peers[0].TunnelIPs = []string{"10.109.0.10"} }, "tunnel address 10.109.0.10 of peer laptop is outside the client pool"},
+		{"peers without a pool", validServer, func(c *Config) { c.ClientPool = "" }, "peers need a client pool"},
+	}
+	for _, test := range tests {
+		cfg := test.cfg()
+		test.change(cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := validClient()
+	cfg.TunName = ""
+	cfg.MTU = 100
+	cfg.ServerAddress = ""
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("validated")
+	}
+	for _, want := range []string{"tunnel interface name is empty", "MTU 100", "no server address given"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is missing from %v", want, err)
+		}
+	}
+}
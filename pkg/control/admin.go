@@ -0,0 +1,21 @@
+package control
+
+import "github.com/kwakubiney/safehaven/config"
+
+// Admin is implemented by every VPN service alongside vpn.VPNService and served on the
+// control socket. Changes made through it last until the next reload or restart.
+type Admin interface {
+	// Status reports the tunnel and its peers, or client sessions
+	Status() (*Status, error)
+	// Stats returns the same counters that are published as metrics
+	Stats() (map[string]interface{}, error)
+	// AddPeer adds a peer to a server, or replaces the peer with the same id
+	AddPeer(peer config.Peer) error
+	// RemovePeer removes the peer with the given id from a server
+	RemovePeer(id string) error
+	// AddRoute and RemoveRoute change the routes through the tunnel on a client
+	AddRoute(dst string) error
+	RemoveRoute(dst string) error
+	// Reconnect makes a client redo its handshake with the server
+	Reconnect() error
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to a running daemon over its control socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{http: &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+// Status fetches the daemon's status
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	if err := c.do(http.MethodGet, "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// AddRoute routes dst through the tunnel of a running client
+func (c *Client) AddRoute(dst string) error {
+	return c.do(http.MethodPost, "/routes?dst="+url.QueryEscape(dst), nil, nil)
+}
+
+// RemoveRoute stops routing dst through the tunnel of a running client
+func (c *Client) RemoveRoute(dst string) error {
+	return c.do(http.MethodDelete, "/routes?dst="+url.QueryEscape(dst), nil, nil)
+}
+
+// Reconnect makes a running client redo its handshake with the server
+func (c *Client) Reconnect() error {
+	return c.do(http.MethodPost, "/reconnect", nil, nil)
+}
+
+func (c *Client) do(method, endpoint string, body io.Reader, v interface{}) error {
+	// The host is ignored, every request goes to the socket
+	request, err := http.NewRequest(method, "http://safehaven"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon, is safehaven running? %w", err)
+	}
+	defer response.Body.Close()
+	return decodeResponse(response, v)
+}
+
+// decodeResponse decodes a successful response into v, or returns the error the daemon sent
+func decodeResponse(response *http.Response, v interface{}) error {
+	if response.StatusCode/100 != 2 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("daemon answered %s", response.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
@@ -0,0 +1,170 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// DefaultSocket is where the daemon listens and commands connect unless told otherwise
+const DefaultSocket = "/run/safehaven.sock"
+
+// Server answers safehaven commands over a Unix socket with a small JSON API. Only root, or
+// whoever runs the daemon, can connect.
+//
+//	GET    /status               the tunnel and its peers
+//	GET    /sessions             the peers, or client sessions, alone
+//	GET    /stats                the metrics counters
+//	POST   /peers                add the peer in the body, replacing the one with its id
+//	DELETE /peers?id=<id>        remove a peer
+//	POST   /routes?dst=<prefix>  route a prefix through the tunnel
+//	DELETE /routes?dst=<prefix>  stop routing a prefix through the tunnel
+//	POST   /reconnect            redo the handshake with the server
+type Server struct {
+	path   string
+	server *http.Server
+}
+
+// Listen serves the control API on a Unix socket at path, replacing a socket left behind by
+// a previous run
+func Listen(path string, admin Admin) (*Server, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another safehaven", path)
+		}
+		os.Remove(path)
+	}
+	// The socket must never be reachable by others, not even between creating and chmodding it
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	s := &Server{path: path, server: &http.Server{Handler: newHandler(admin)}}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving control socket: %v", err)
+		}
+	}()
+	log.Printf("Control socket listening on %s", path)
+	return s, nil
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() error {
+	err := s.server.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func newHandler(admin Admin) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", only(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		status, err := admin.Status()
+		respond(w, status, err)
+	}))
+	mux.HandleFunc("/sessions", only(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		status, err := admin.Status()
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		respond(w, status.Peers, nil)
+	}))
+	mux.HandleFunc("/stats", only(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		stats, err := admin.Stats()
+		respond(w, stats, err)
+	}))
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var peer config.Peer
+			if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer: %w", err))
+				return
+			}
+			if peer.ID == "" {
+				writeError(w, http.StatusBadRequest, errors.New("the peer has no id"))
+				return
+			}
+			log.Printf("Adding peer %s through the control socket", peer.ID)
+			respond(w, nil, admin.AddPeer(peer))
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				writeError(w, http.StatusBadRequest, errors.New("missing id"))
+				return
+			}
+			log.Printf("Removing peer %s through the control socket", id)
+			respond(w, nil, admin.RemovePeer(id))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		dst := r.URL.Query().Get("dst")
+		if dst == "" && (r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+			writeError(w, http.StatusBadRequest, errors.New("missing dst"))
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			respond(w, nil, admin.AddRoute(dst))
+		case http.MethodDelete:
+			respond(w, nil, admin.RemoveRoute(dst))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/reconnect", only(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Reconnecting on request through the control socket")
+		respond(w, nil, admin.Reconnect())
+	}))
+	return mux
+}
+
+// only rejects requests with any other method than method
+func only(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// respond writes v, or err if the request failed. A nil v answers with no content.
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing control response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
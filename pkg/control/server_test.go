@@ -0,0 +1,196 @@
+package control
+
+import (
+	"errors"
+	"github.com/kwakubiney/safehaven/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListenRestrictsSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "safehaven.sock")
+	server, err := Listen(path, &fakeAdmin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %s, want only the owner to connect", info.Mode().Perm())
+	}
+	if _, err := Listen(path, &fakeAdmin{}); err == nil {
+		t.Error("a second daemon took over a socket in use")
+	}
+}
+
+// fakeAdmin records the calls made to it and fails them all with err when set
+type fakeAdmin struct {
+	err     error
+	status  *Status
+	stats   map[string]interface{}
+	peers   []config.Peer
+	removed []string
+	added   []string
+	deleted []string
+	redials int
+}
+
+func (a *fakeAdmin) Status() (*Status, error) {
+	return a.status, a.err
+}
+
+func (a *fakeAdmin) Stats() (map[string]interface{}, error) {
+	return a.stats, a.err
+}
+
+func (a *fakeAdmin) AddPeer(peer config.Peer) error {
+	a.peers = append(a.peers, peer)
+	return a.err
+}
+
+func (a *fakeAdmin) RemovePeer(id string) error {
+	a.removed = append(a.removed, id)
+	return a.err
+}
+
+func (a *fakeAdmin) AddRoute(dst string) error {
+	a.added = append(a.added, dst)
+	return a.err
+}
+
+func (a *fakeAdmin) RemoveRoute(dst string) error {
+	a.deleted = append(a.deleted, dst)
+	return a.err
+}
+
+func (a *fakeAdmin) Reconnect() error {
+	a.redials++
+	return a.err
+}
+
+func TestHandler(t *testing.T) {
+	admin := &fakeAdmin{
+		status: &Status{Transport: "plain", Mode: "server", Peers: []PeerStatus{{ID: "alice", AllowedIPs: []string{"10.108.0.2/32"}}}},
+		stats:  map[string]interface{}{"sessions": 1},
+	}
+	handler := newHandler(admin)
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		code   int
+		want   string
+	}{
+		{http.MethodGet, "/status", "", http.StatusOK, `{"transport":"plain","mode":"server","interface":"","peers":[{"id":"alice","allowed_ips":["10.108.0.2/32"],"rx_bytes":0,"tx_bytes":0}]}`},
+		{http.MethodGet, "/sessions", "", http.StatusOK, `[{"id":"alice","allowed_ips":["10.108.0.2/32"],"rx_bytes":0,"tx_bytes":0}]`},
+		{http.MethodGet, "/stats", "", http.StatusOK, `{"sessions":1}`},
+		{http.MethodPost, "/peers", `{"id":"bob","tunnel_ips":["10.108.0.3"]}`, http.StatusNoContent, ""},
+		{http.MethodDelete, "/peers?id=bob", "", http.StatusNoContent, ""},
+		{http.MethodPost, "/routes?dst=10.0.0.0/8", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/routes?dst=10.0.0.0/8", "", http.StatusNoContent, ""},
+		{http.MethodPost, "/reconnect", "", http.StatusNoContent, ""},
+		{http.MethodPost, "/status", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/reconnect", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodPut, "/peers", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/routes?dst=10.0.0.0/8", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/peers", `{"id":`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/peers", `{"tunnel_ips":["10.108.0.3"]}`, http.StatusBadRequest, `{"error":"the peer has no id"}`},
+		{http.MethodDelete, "/peers", "", http.StatusBadRequest, `{"error":"missing id"}`},
+		{http.MethodPost, "/routes", "", http.StatusBadRequest, `{"error":"missing dst"}`},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+		if recorder.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.target, recorder.Code, test.code)
+			continue
+		}
+		if body := strings.TrimSpace(recorder.Body.String()); test.want != "" && body != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.method, test.target, body, test.want)
+		}
+	}
+
+	if len(admin.peers) != 1 || admin.peers[0].ID != "bob" || !reflect.DeepEqual(admin.peers[0].TunnelIPs, []string{"10.108.0.3"}) {
+		t.Errorf("added peers %+v", admin.peers)
+	}
+	if !reflect.DeepEqual(admin.removed, []string{"bob"}) {
+		t.Errorf("removed peers %v", admin.removed)
+	}
+	if !reflect.DeepEqual(admin.added, []string{"10.0.0.0/8"}) || !reflect.DeepEqual(admin.deleted, []string{"10.0.0.0/8"}) {
+		t.Errorf("added routes %v, removed routes %v", admin.added, admin.deleted)
+	}
+	if admin.redials != 1 {
+		t.Errorf("%d reconnects, want 1", admin.redials)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	handler := newHandler(&fakeAdmin{err: errors.New("WireGuard device is not running")})
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/status", nil),
+		httptest.NewRequest(http.MethodGet, "/sessions", nil),
+		httptest.NewRequest(http.MethodGet, "/stats", nil),
+		httptest.NewRequest(http.MethodPost, "/peers", strings.NewReader(`{"id":"bob"}`)),
+		httptest.NewRequest(http.MethodDelete, "/peers?id=bob", nil),
+		httptest.NewRequest(http.MethodPost, "/routes?dst=10.0.0.0/8", nil),
+		httptest.NewRequest(http.MethodDelete, "/routes?dst=10.0.0.0/8", nil),
+		httptest.NewRequest(http.MethodPost, "/reconnect", nil),
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		body := strings.TrimSpace(recorder.Body.String())
+		if recorder.Code != http.StatusInternalServerError || body != `{"error":"WireGuard device is not running"}` {
+			t.Errorf("%s %s: got %d %s", request.Method, request.URL, recorder.Code, body)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "safehaven.sock")
+	admin := &fakeAdmin{status: &Status{Transport: "wireguard", Mode: "client", Interface: "wg0"}}
+	server, err := Listen(path, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewClient(path)
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(status, admin.status) {
+		t.Errorf("got status %+v, want %+v", status, admin.status)
+	}
+	if err := client.AddRoute("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveRoute("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(admin.added, []string{"10.0.0.0/8"}) || !reflect.DeepEqual(admin.deleted, []string{"10.1.0.0/16"}) || admin.redials != 1 {
+		t.Errorf("added %v, removed %v, %d reconnects", admin.added, admin.deleted, admin.redials)
+	}
+
+	// The daemon's error comes back as the command's error
+	admin.err = errors.New("routes can only be changed on a client")
+	if err := client.AddRoute("10.0.0.0/8"); err == nil || err.Error() != admin.err.Error() {
+		t.Errorf("got %v, want %v", err, admin.err)
+	}
+	if _, err := NewClient(filepath.Join(t.TempDir(), "missing.sock")).Status(); err == nil {
+		t.Error("reached a daemon that is not running")
+	}
+}
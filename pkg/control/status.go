@@ -0,0 +1,26 @@
+package control
+
+import "time"
+
+// Status is a snapshot of the running tunnel
+type Status struct {
+	Transport  string       `json:"transport"`
+	Mode       string       `json:"mode"`
+	Interface  string       `json:"interface"`
+	PublicKey  string       `json:"public_key,omitempty"`
+	ListenPort int          `json:"listen_port,omitempty"`
+	Peers      []PeerStatus `json:"peers"`
+}
+
+// PeerStatus describes one peer, or one client session with the plain transport
+type PeerStatus struct {
+	ID                  string     `json:"id,omitempty"`
+	PublicKey           string     `json:"public_key,omitempty"`
+	Endpoint            string     `json:"endpoint,omitempty"`
+	AllowedIPs          []string   `json:"allowed_ips"`
+	LatestHandshake     *time.Time `json:"latest_handshake,omitempty"`
+	LastSeen            *time.Time `json:"last_seen,omitempty"`
+	RxBytes             uint64     `json:"rx_bytes"`
+	TxBytes             uint64     `json:"tx_bytes"`
+	PersistentKeepalive int        `json:"persistent_keepalive,omitempty"`
+}
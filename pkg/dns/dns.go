@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	resolvConf       = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.safehaven"
+)
+
+// Settings are the DNS servers and search domains to use while the tunnel is up
+type Settings struct {
+	Servers       []string
+	SearchDomains []string
+	// RoutingDomains are only looked up through Servers, without being used as search domains.
+	// Like Default they need systemd-resolved.
+	RoutingDomains []string
+	// Default sends all queries to Servers rather than only those for SearchDomains. It only
+	// makes a difference with systemd-resolved, resolv.conf has no notion of per link DNS.
+	Default bool
+}
+
+// Apply configures the system resolver to use settings on tunName, through systemd-resolved
+// when it is running and by rewriting /etc/resolv.conf otherwise. The previous configuration
+// is restored on undo.
+func Apply(undo *netconf.Undo, tunName string, settings Settings) error {
+	if len(settings.Servers) == 0 {
+		return nil
+	}
+	if resolvedRunning() {
+		return applyResolved(undo, tunName, settings)
+	}
+	return applyResolvConf(undo, settings)
+}
+
+func resolvedRunning() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve")
+	return err == nil
+}
+
+func applyResolved(undo *netconf.Undo, tunName string, settings Settings) error {
+	if err := resolvectl(append([]string{"dns", tunName}, settings.Servers...)...); err != nil {
+		return err
+	}
+	undo.Push(fmt.Sprintf("DNS settings of %s", tunName), func() error {
+		return resolvectl("revert", tunName)
+	})
+
+	domains := append([]string{}, settings.SearchDomains...)
+	for _, domain := range settings.RoutingDomains {
+		domains = append(domains, "~"+domain)
+	}
+	if settings.Default {
+		// "~." makes this link the route for every query that has no more specific one
+		domains = append([]string{"~."}, domains...)
+	}
+	if len(domains) > 0 {
+		if err := resolvectl(append([]string{"domain", tunName}, domains...)...); err != nil {
+			return err
+		}
+	}
+	if settings.Default {
+		if err := resolvectl("default-route", tunName, "true"); err != nil {
+			return err
+		}
+	}
+	log.Printf("DNS for %s set to %v with search domains %v via systemd-resolved", tunName, settings.Servers, settings.SearchDomains)
+	return nil
+}
+
+func resolvectl(args ...string) error {
+	output, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// applyResolvConf replaces /etc/resolv.conf, keeping the original next to it. The backup is
+// left behind if we crash and put back by the next run.
+func applyResolvConf(undo *netconf.Undo, settings Settings) error {
+	if err := restoreBackup(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to restore %s left behind by a previous run: %w", resolvConf, err)
+	}
+
+	// resolv.conf is often a symlink managed by something else, so move it aside as it is
+	// rather than overwriting its target
+	if err := os.Rename(resolvConf, resolvConfBackup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to back up %s: %w", resolvConf, err)
+	}
+	undo.Push(resolvConf, restoreBackup)
+
+	var content strings.Builder
+	content.WriteString("# Generated by SafeHaven, the original is restored on shutdown\n")
+	for _, server := range settings.Servers {
+		fmt.Fprintf(&content, "nameserver %s\n", server)
+	}
+	if len(settings.SearchDomains) > 0 {
+		fmt.Fprintf(&content, "search %s\n", strings.Join(settings.SearchDomains, " "))
+	}
+	if err := os.WriteFile(resolvConf, []byte(content.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", resolvConf, err)
+	}
+	log.Printf("DNS set to %v with search domains %v in %s", settings.Servers, settings.SearchDomains, resolvConf)
+	return nil
+}
+
+// restoreBackup moves the original resolv.conf back in place
+func restoreBackup() error {
+	if _, err := os.Lstat(resolvConfBackup); err != nil {
+		return err
+	}
+	return os.Rename(resolvConfBackup, resolvConf)
+}
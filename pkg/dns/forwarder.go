@@ -0,0 +1,217 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsPort         = "53"
+	upstreamTimeout = 3 * time.Second
+)
+
+// Rule sends queries for Domain and all of its subdomains to Resolver
+type Rule struct {
+	Domain   string
+	Resolver string
+}
+
+// ParseRules parses rules written as domain=resolver, e.g. internal=10.108.0.53
+func ParseRules(rules []string) ([]Rule, error) {
+	var parsed []Rule
+	for _, rule := range rules {
+		domain, resolver, found := strings.Cut(rule, "=")
+		domain = strings.Trim(strings.TrimSpace(domain), ".")
+		resolver = strings.TrimSpace(resolver)
+		if !found || domain == "" || net.ParseIP(resolver) == nil {
+			return nil, fmt.Errorf("invalid DNS forwarding rule %q, expected domain=resolver-ip", rule)
+		}
+		parsed = append(parsed, Rule{Domain: strings.ToLower(domain), Resolver: resolver})
+	}
+	return parsed, nil
+}
+
+// Forwarder is a small DNS forwarder that sends queries matching a rule to the rule's resolver
+// and everything else to the fallback resolvers
+type Forwarder struct {
+	conn     *net.UDPConn
+	rules    []Rule
+	fallback []string
+}
+
+// Forward starts a forwarder for rules on listenIP and points the system resolver at it for the
+// rule domains. The forwarder is stopped and the resolver configuration restored on undo.
+func Forward(undo *netconf.Undo, tunName string, listenIP net.IP, rules []Rule) error {
+	// Read the system resolvers before Apply gets a chance to replace them with our own
+	fallback, err := systemResolvers(listenIP)
+	if err != nil {
+		return err
+	}
+	forwarder, err := NewForwarder(listenIP, rules, fallback)
+	if err != nil {
+		return err
+	}
+	go forwarder.Serve()
+	undo.Push("DNS forwarder", forwarder.Close)
+	log.Printf("DNS forwarder listening on %s for %v, falling back to %v", forwarder.conn.LocalAddr(), rules, fallback)
+
+	var domains []string
+	for _, rule := range rules {
+		domains = append(domains, rule.Domain)
+	}
+	return Apply(undo, tunName, Settings{Servers: []string{listenIP.String()}, RoutingDomains: domains})
+}
+
+func NewForwarder(listenIP net.IP, rules []Rule, fallback []string) (*Forwarder, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: listenIP, Port: 53})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start DNS forwarder on %s: %w", listenIP, err)
+	}
+	return &Forwarder{conn: conn, rules: rules, fallback: fallback}, nil
+}
+
+// Serve answers queries until the forwarder is closed
+func (f *Forwarder) Serve() {
+	for {
+		query := make([]byte, 512)
+		n, client, err := f.conn.ReadFromUDP(query)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error receiving DNS query: %v", err)
+			continue
+		}
+		go f.answer(query[:n], client)
+	}
+}
+
+func (f *Forwarder) Close() error {
+	return f.conn.Close()
+}
+
+func (f *Forwarder) answer(query []byte, client *net.UDPAddr) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+
+	var response []byte
+	for _, resolver := range f.resolversFor(question.Name.String()) {
+		response, err = exchange(query, resolver)
+		if err == nil {
+			break
+		}
+		log.Printf("DNS query for %s to %s failed: %v", question.Name, resolver, err)
+	}
+	if response == nil {
+		response, err = serverFailure(header, question)
+		if err != nil {
+			return
+		}
+	}
+	if _, err := f.conn.WriteToUDP(response, client); err != nil {
+		log.Printf("Error answering DNS query: %v", err)
+	}
+}
+
+// resolversFor returns the resolver of the most specific rule matching name, or the fallback
+// resolvers if none does
+func (f *Forwarder) resolversFor(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var best *Rule
+	for i, rule := range f.rules {
+		if name != rule.Domain && !strings.HasSuffix(name, "."+rule.Domain) {
+			continue
+		}
+		if best == nil || len(rule.Domain) > len(best.Domain) {
+			best = &f.rules[i]
+		}
+	}
+	if best != nil {
+		return []string{best.Resolver}
+	}
+	return f.fallback
+}
+
+func exchange(query []byte, resolver string) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(resolver, dnsPort), upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(upstreamTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+func serverFailure(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	header.Response = true
+	header.RCode = dnsmessage.RCodeServerFailure
+	builder := dnsmessage.NewBuilder(nil, header)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// systemResolvers returns the nameservers listed in /etc/resolv.conf, other than the forwarder's
+// own address. A crashed run leaves its resolv.conf in place, so the original kept in the
+// backup is read when there is one.
+func systemResolvers(listenIP net.IP) ([]string, error) {
+	path := resolvConf
+	if _, err := os.Lstat(resolvConfBackup); err == nil {
+		path = resolvConfBackup
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system resolvers: %w", err)
+	}
+	defer file.Close()
+
+	var resolvers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Forwarding to ourselves would loop until we run out of sockets
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.Equal(listenIP) {
+			continue
+		}
+		resolvers = append(resolvers, fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read system resolvers: %w", err)
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s to fall back to", path)
+	}
+	return resolvers, nil
+}
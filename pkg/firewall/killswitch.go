@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"github.com/kwakubiney/safehaven/utils"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const killSwitchTable = "safehaven_killswitch"
+
+// KillSwitch describes the only traffic allowed out while the kill switch is on
+type KillSwitch struct {
+	TunName   string
+	Endpoints []netip.AddrPort
+	// Bypass holds networks deliberately kept off the tunnel
+	Bypass []*net.IPNet
+}
+
+// ClientKillSwitch builds the kill switch for a client: its servers and excluded routes stay
+// reachable outside the tunnel
+func ClientKillSwitch(cfg *config.Config) (*KillSwitch, error) {
+	endpoints, err := utils.ResolveEndpoints(utils.SplitAddressList(cfg.ServerAddress))
+	if err != nil {
+		return nil, err
+	}
+	killSwitch := &KillSwitch{TunName: cfg.TunName, Endpoints: endpoints}
+	for _, excluded := range cfg.ExcludedRoutes {
+		network, err := utils.ParsePrefix(excluded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded route %s: %w", excluded, err)
+		}
+		killSwitch.Bypass = append(killSwitch.Bypass, network)
+	}
+	return killSwitch, nil
+}
+
+// ServerEndpoints returns the endpoints of the configured servers. Once the kill switch k is on,
+// name resolution outside the tunnel is dropped, so those it was built with are returned
+// instead of resolving the servers again.
+func ServerEndpoints(cfg *config.Config, k *KillSwitch) ([]netip.AddrPort, error) {
+	if k != nil {
+		return k.Endpoints, nil
+	}
+	return utils.ResolveEndpoints(utils.SplitAddressList(cfg.ServerAddress))
+}
+
+// Enable drops all outgoing traffic except loopback, the tunnel interface, the servers, the
+// bypass networks, and the DHCP and IPv6 neighbour and router discovery traffic that keeps
+// the physical link configured. The rules live in the kernel, so they stay in place if we crash and
+// are only removed by undo on a clean shutdown, or by `nft delete table inet safehaven_killswitch`.
+func (k KillSwitch) Enable(undo *netconf.Undo) error {
+	var body strings.Builder
+	body.WriteString("\tchain output {\n")
+	body.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	body.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&body, "\t\toifname %q accept\n", k.TunName)
+	body.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	body.WriteString("\t\tudp sport 546 udp dport 547 accept\n")
+	body.WriteString("\t\ticmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept\n")
+	for _, endpoint := range k.Endpoints {
+		fmt.Fprintf(&body, "\t\t%s daddr %s udp dport %d accept\n",
+			addressFamily(endpoint.Addr()), endpoint.Addr(), endpoint.Port())
+	}
+	for _, network := range k.Bypass {
+		addr, _ := netip.AddrFromSlice(network.IP)
+		fmt.Fprintf(&body, "\t\t%s daddr %s accept\n", addressFamily(addr.Unmap()), network)
+	}
+	body.WriteString("\t}\n")
+
+	if err := replaceTable(killSwitchTable, body.String()); err != nil {
+		return fmt.Errorf("failed to enable kill switch: %w", err)
+	}
+	undo.Push("kill switch", func() error {
+		return deleteTable(killSwitchTable)
+	})
+	log.Printf("Kill switch enabled - only traffic through %s and to %v is allowed out", k.TunName, k.Endpoints)
+	return nil
+}
+
+func addressFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "ip"
+	}
+	return "ip6"
+}
@@ -0,0 +1,77 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"github.com/kwakubiney/safehaven/utils"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const natTable = "safehaven_nat"
+
+// TunnelSubnets returns the networks client traffic is sourced from on a server: those of its
+// own tunnel addresses and of the client pool, or of the static client address without one.
+// WireGuard servers use the addresses of their peers, and the static client address only for
+// the legacy client peer.
+func TunnelSubnets(cfg *config.Config) ([]*net.IPNet, error) {
+	networks := utils.SplitAddressList(cfg.ServerTunIP)
+	switch {
+	case cfg.ClientPool != "":
+		networks = append(networks, utils.SplitAddressList(cfg.ClientPool)...)
+	case cfg.WireGuardConfig != nil:
+		for _, peer := range cfg.Peers {
+			networks = append(networks, peer.TunnelIPs...)
+		}
+		if cfg.WireGuardConfig.ClientPublicKey != "" {
+			networks = append(networks, utils.SplitAddressList(cfg.ClientTunIP)...)
+		}
+	default:
+		networks = append(networks, utils.SplitAddressList(cfg.ClientTunIP)...)
+	}
+	return netconf.SplitTunnel(networks, nil)
+}
+
+// EnableNAT turns on IP forwarding and masquerades traffic from subnets leaving through the
+// egress interface, so clients can reach whatever the server can. Forwarding is restored to
+// its previous setting and the masquerade rules removed on undo.
+func EnableNAT(undo *netconf.Undo, egress string, subnets []*net.IPNet) error {
+	var body strings.Builder
+	body.WriteString("\tchain postrouting {\n")
+	body.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	var hasIPv4, hasIPv6 bool
+	for _, subnet := range subnets {
+		addr, _ := netip.AddrFromSlice(subnet.IP)
+		addr = addr.Unmap()
+		if addr.Is4() {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+		fmt.Fprintf(&body, "\t\toifname %q %s saddr %s masquerade\n", egress, addressFamily(addr), subnet)
+	}
+	body.WriteString("\t}\n")
+
+	if hasIPv4 {
+		if err := undo.SetSysctl("net.ipv4.ip_forward", "1"); err != nil {
+			return err
+		}
+	}
+	if hasIPv6 {
+		if err := undo.SetSysctl("net.ipv6.conf.all.forwarding", "1"); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceTable(natTable, body.String()); err != nil {
+		return fmt.Errorf("failed to set up NAT: %w", err)
+	}
+	undo.Push("NAT rules", func() error {
+		return deleteTable(natTable)
+	})
+	log.Printf("Masquerading traffic from %v out of %s", subnets, egress)
+	return nil
+}
@@ -0,0 +1,28 @@
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// run feeds script to nft, which applies it as a single atomic transaction
+func run(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// replaceTable atomically swaps the named inet table for body, so a table left behind by a
+// crashed run is replaced rather than duplicated
+func replaceTable(name, body string) error {
+	return run(fmt.Sprintf("add table inet %s\ndelete table inet %s\ntable inet %s {\n%s}\n", name, name, name, body))
+}
+
+func deleteTable(name string) error {
+	return run(fmt.Sprintf("delete table inet %s\n", name))
+}
@@ -0,0 +1,381 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
+// Lease binds a tunnel address from the pool to a client. Updated is the last time the
+// client asked for it or was seen connected.
+type Lease struct {
+	ClientID string     `json:"client_id"`
+	Address  netip.Addr `json:"address"`
+	Updated  time.Time  `json:"updated"`
+}
+
+// Pool hands out tunnel addresses from one CIDR per address family and persists the
+// leases to a file so that clients keep their addresses across server restarts.
+type Pool struct {
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+	path     string
+	// leaseTime is how long a lease outlives its client, 0 keeps leases forever
+	leaseTime time.Duration
+	reserved  map[netip.Addr]bool
+	leases    map[string][]*Lease
+	byAddr    map[netip.Addr]*Lease
+}
+
+// NewPool creates a pool over the given CIDRs, loading any leases already stored at leaseFile.
+// Leases not renewed for leaseTime are reclaimed by Expire. Addresses in reserved (e.g. the
+// server's own tunnel IPs) are never handed out.
+func NewPool(cidrs []string, leaseFile string, leaseTime time.Duration, reserved ...netip.Addr) (*Pool, error) {
+	pool := &Pool{
+		path:      leaseFile,
+		leaseTime: leaseTime,
+		reserved:  map[netip.Addr]bool{},
+		leases:    map[string][]*Lease{},
+		byAddr:    map[netip.Addr]*Lease{},
+	}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool %s: %w", cidr, err)
+		}
+		prefix = prefix.Masked()
+		for _, existing := range pool.prefixes {
+			if existing.Overlaps(prefix) {
+				return nil, fmt.Errorf("pool %s overlaps %s", prefix, existing)
+			}
+		}
+		pool.prefixes = append(pool.prefixes, prefix)
+
+		pool.reserved[prefix.Addr()] = true
+		if broadcast, ok := lastAddr(prefix); ok && prefix.Addr().Is4() {
+			pool.reserved[broadcast] = true
+		}
+	}
+	if len(pool.prefixes) == 0 {
+		return nil, errors.New("pool needs at least one CIDR")
+	}
+	for _, addr := range reserved {
+		pool.reserved[addr.Unmap()] = true
+	}
+
+	if err := pool.load(); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Prefixes returns the CIDRs the pool allocates from
+func (p *Pool) Prefixes() []netip.Prefix {
+	return p.prefixes
+}
+
+// Contains reports whether addr belongs to the pool
+func (p *Pool) Contains(addr netip.Addr) bool {
+	_, ok := p.prefixFor(addr)
+	return ok
+}
+
+// PrefixFor returns addr with the prefix length of the pool CIDR it belongs to
+func (p *Pool) PrefixFor(addr netip.Addr) (netip.Prefix, bool) {
+	prefix, ok := p.prefixFor(addr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr.Unmap(), prefix.Bits()), true
+}
+
+// Allocate returns the addresses leased to clientID, leasing a free one from every
+// CIDR the client has no address in yet
+func (p *Pool) Allocate(clientID string) ([]netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var addrs []netip.Addr
+	var added []*Lease
+	for _, prefix := range p.prefixes {
+		if lease := p.leaseIn(clientID, prefix); lease != nil {
+			lease.Updated = time.Now()
+			addrs = append(addrs, lease.Address)
+			continue
+		}
+		addr, err := p.free(prefix)
+		if err != nil {
+			// Give back what this call leased, the client is refused anyway
+			for _, lease := range added {
+				p.remove(lease)
+			}
+			return nil, err
+		}
+		lease := &Lease{ClientID: clientID, Address: addr, Updated: time.Now()}
+		p.add(lease)
+		added = append(added, lease)
+		addrs = append(addrs, addr)
+	}
+	return addrs, p.save()
+}
+
+// Reserve leases a specific address to clientID, replacing its lease in the same CIDR
+func (p *Pool) Reserve(clientID string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prefix, err := p.available(clientID, addr)
+	if err != nil {
+		return err
+	}
+	if lease := p.leaseIn(clientID, prefix); lease != nil {
+		if lease.Address == addr {
+			lease.Updated = time.Now()
+			return p.save()
+		}
+		p.remove(lease)
+	}
+	p.add(&Lease{ClientID: clientID, Address: addr, Updated: time.Now()})
+	return p.save()
+}
+
+// Replace leases exactly addrs to clientID, at most one per CIDR, and releases its other
+// leases. If any of addrs is unavailable the leases are left as they were.
+func (p *Pool) Replace(clientID string, addrs []netip.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	taken := map[netip.Prefix]netip.Addr{}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		prefix, err := p.available(clientID, addr)
+		if err != nil {
+			return err
+		}
+		if other, ok := taken[prefix]; ok {
+			return fmt.Errorf("addresses %s and %s are both in %s", other, addr, prefix)
+		}
+		taken[prefix] = addr
+	}
+
+	for _, lease := range append([]*Lease(nil), p.leases[clientID]...) {
+		p.remove(lease)
+	}
+	for _, addr := range taken {
+		p.add(&Lease{ClientID: clientID, Address: addr, Updated: time.Now()})
+	}
+	return p.save()
+}
+
+// Release returns the addresses leased to clientID to the pool
+func (p *Pool) Release(clientID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leases, ok := p.leases[clientID]
+	if !ok {
+		return nil
+	}
+	for _, lease := range append([]*Lease(nil), leases...) {
+		p.remove(lease)
+	}
+	return p.save()
+}
+
+// Expire releases the leases not renewed for longer than the lease time and returns them.
+// The leases of clients keep reports true for, such as connected clients and peers, are
+// renewed instead.
+func (p *Pool) Expire(keep func(clientID string) bool) ([]Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.leaseTime <= 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	var expired []Lease
+	for clientID, leases := range p.leases {
+		if keep(clientID) {
+			for _, lease := range leases {
+				lease.Updated = now
+			}
+			continue
+		}
+		for _, lease := range append([]*Lease(nil), leases...) {
+			if now.Sub(lease.Updated) > p.leaseTime {
+				p.remove(lease)
+				expired = append(expired, *lease)
+			}
+		}
+	}
+	return expired, p.save()
+}
+
+// Lookup returns the leases held by clientID
+func (p *Pool) Lookup(clientID string) []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var leases []Lease
+	for _, lease := range p.leases[clientID] {
+		leases = append(leases, *lease)
+	}
+	return leases
+}
+
+// Leases returns every active lease ordered by address
+func (p *Pool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leases := make([]Lease, 0, len(p.byAddr))
+	for _, lease := range p.byAddr {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Address.Less(leases[j].Address)
+	})
+	return leases
+}
+
+func (p *Pool) prefixFor(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// available returns the CIDR of addr if it can be leased to clientID
+func (p *Pool) available(clientID string, addr netip.Addr) (netip.Prefix, error) {
+	prefix, ok := p.prefixFor(addr)
+	if !ok || p.reserved[addr] {
+		return netip.Prefix{}, fmt.Errorf("address %s is not available in the pool", addr)
+	}
+	if owner := p.byAddr[addr]; owner != nil && owner.ClientID != clientID {
+		return netip.Prefix{}, fmt.Errorf("address %s is already leased to %s", addr, owner.ClientID)
+	}
+	return prefix, nil
+}
+
+func (p *Pool) leaseIn(clientID string, prefix netip.Prefix) *Lease {
+	for _, lease := range p.leases[clientID] {
+		if prefix.Contains(lease.Address) {
+			return lease
+		}
+	}
+	return nil
+}
+
+func (p *Pool) free(prefix netip.Prefix) (netip.Addr, error) {
+	for addr := prefix.Addr().Next(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if !p.reserved[addr] && p.byAddr[addr] == nil {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrPoolExhausted, prefix)
+}
+
+func (p *Pool) add(lease *Lease) {
+	p.leases[lease.ClientID] = append(p.leases[lease.ClientID], lease)
+	p.byAddr[lease.Address] = lease
+}
+
+func (p *Pool) remove(lease *Lease) {
+	leases := p.leases[lease.ClientID]
+	for i, held := range leases {
+		if held == lease {
+			leases = append(leases[:i], leases[i+1:]...)
+			break
+		}
+	}
+	if len(leases) == 0 {
+		delete(p.leases, lease.ClientID)
+	} else {
+		p.leases[lease.ClientID] = leases
+	}
+	delete(p.byAddr, lease.Address)
+}
+
+func (p *Pool) load() error {
+	if p.path == "" {
+		return nil
+	}
+	file, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lease file: %w", err)
+	}
+
+	var leases []*Lease
+	if err := json.Unmarshal(file, &leases); err != nil {
+		return fmt.Errorf("failed to parse lease file: %w", err)
+	}
+	for _, lease := range leases {
+		// Leases outside the current pool are left over from an older configuration
+		prefix, ok := p.prefixFor(lease.Address)
+		if !ok || p.reserved[lease.Address] || p.byAddr[lease.Address] != nil || p.leaseIn(lease.ClientID, prefix) != nil {
+			continue
+		}
+		p.add(lease)
+	}
+	return nil
+}
+
+// save writes the leases to a temporary file and renames it over the lease file
+// so a crash mid-write never leaves a truncated file behind.
+func (p *Pool) save() error {
+	if p.path == "" {
+		return nil
+	}
+	leases := make([]*Lease, 0, len(p.byAddr))
+	for _, lease := range p.byAddr {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Address.Less(leases[j].Address)
+	})
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode leases: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	return nil
+}
+
+// lastAddr returns the highest address in prefix
+func lastAddr(prefix netip.Prefix) (netip.Addr, bool) {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	return netip.AddrFromSlice(bytes)
+}
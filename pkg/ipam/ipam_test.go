@@ -0,0 +1,261 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAllocate(t *testing.T) {
+	server := netip.MustParseAddr("10.108.0.1")
+	pool, err := NewPool([]string{"10.108.0.0/30", "fd00::/126"}, "", 0, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := pool.Allocate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("10.108.0.2"), netip.MustParseAddr("fd00::1")}
+	if len(addrs) != 2 || addrs[0] != want[0] || addrs[1] != want[1] {
+		t.Fatalf("alice got %v, want %v", addrs, want)
+	}
+	again, err := pool.Allocate("alice")
+	if err != nil || len(again) != 2 || again[0] != want[0] || again[1] != want[1] {
+		t.Fatalf("alice got %v, %v on her second request, want %v", again, err, want)
+	}
+
+	// The /30 has no address left once the network, broadcast and server are taken
+	if _, err := pool.Allocate("bob"); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("bob got %v, want %v", err, ErrPoolExhausted)
+	}
+	if err := pool.Release("alice"); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = pool.Allocate("bob")
+	if err != nil || addrs[0] != want[0] {
+		t.Fatalf("bob got %v, %v after alice released, want %s", addrs, err, want[0])
+	}
+}
+
+func TestReserve(t *testing.T) {
+	pool, err := NewPool([]string{"10.108.0.0/24"}, "", 0, netip.MustParseAddr("10.108.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("alice", netip.MustParseAddr("10.108.0.10")); err != nil {
+		t.Fatal(err)
+	}
+	// A new reservation in the same CIDR replaces the old one
+	if err := pool.Reserve("alice", netip.MustParseAddr("10.108.0.20")); err != nil {
+		t.Fatal(err)
+	}
+	leases := pool.Lookup("alice")
+	if len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.20") {
+		t.Fatalf("alice holds %v, want only 10.108.0.20", leases)
+	}
+
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"leased to another client", "10.108.0.20"},
+		{"server address", "10.108.0.1"},
+		{"network address", "10.108.0.0"},
+		{"broadcast address", "10.108.0.255"},
+		{"outside the pool", "10.109.0.10"},
+	}
+	for _, test := range tests {
+		if err := pool.Reserve("bob", netip.MustParseAddr(test.addr)); err == nil {
+			t.Errorf("%s: reserved %s", test.name, test.addr)
+		}
+	}
+	if err := pool.Reserve("bob", netip.MustParseAddr("::ffff:10.108.0.10")); err != nil {
+		t.Errorf("mapped address: %v", err)
+	}
+}
+
+func TestLeaseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	pool, err := NewPool([]string{"10.108.0.0/24"}, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("alice", netip.MustParseAddr("10.108.0.10")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Allocate("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewPool([]string{"10.108.0.0/24"}, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases := reloaded.Lookup("alice"); len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.10") {
+		t.Errorf("alice holds %v after a reload, want 10.108.0.10", leases)
+	}
+	if len(reloaded.Leases()) != 2 {
+		t.Errorf("reloaded %v, want two leases", reloaded.Leases())
+	}
+
+	// Leases outside a shrunk pool or on addresses now reserved are dropped
+	shrunk, err := NewPool([]string{"10.108.0.0/29"}, path, 0, netip.MustParseAddr("10.108.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases := shrunk.Leases(); len(leases) != 0 {
+		t.Errorf("shrunk pool kept %v", leases)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPool([]string{"10.108.0.0/24"}, path, 0); err == nil {
+		t.Error("corrupt lease file loaded")
+	}
+}
+
+func TestLoadSkipsConflictingLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	data, err := json.Marshal([]Lease{
+		{ClientID: "alice", Address: netip.MustParseAddr("10.108.0.10")},
+		{ClientID: "bob", Address: netip.MustParseAddr("10.108.0.10")},
+		{ClientID: "alice", Address: netip.MustParseAddr("10.108.0.11")},
+		{ClientID: "carol", Address: netip.MustParseAddr("10.108.0.1")},
+		{ClientID: "dave", Address: netip.MustParseAddr("192.168.0.10")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool([]string{"10.108.0.0/24"}, path, 0, netip.MustParseAddr("10.108.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := pool.Leases()
+	if len(leases) != 1 || leases[0].ClientID != "alice" || leases[0].Address != netip.MustParseAddr("10.108.0.10") {
+		t.Errorf("loaded %v, want only alice on 10.108.0.10", leases)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	pool, err := NewPool([]string{"10.108.0.0/24"}, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientID := range []string{"gone", "recent", "connected"} {
+		if _, err := pool.Allocate(clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	pool.leases["gone"][0].Updated = old
+	pool.leases["connected"][0].Updated = old
+
+	expired, err := pool.Expire(func(clientID string) bool { return clientID == "connected" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ClientID != "gone" {
+		t.Fatalf("expired %v, want only gone", expired)
+	}
+	if len(pool.Lookup("gone")) != 0 || len(pool.Lookup("recent")) != 1 {
+		t.Errorf("leases left %v", pool.Leases())
+	}
+	if leases := pool.Lookup("connected"); len(leases) != 1 || !leases[0].Updated.After(old) {
+		t.Errorf("connected lease %v was not renewed", leases)
+	}
+
+	forever, err := NewPool([]string{"10.108.0.0/24"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forever.Allocate("gone"); err != nil {
+		t.Fatal(err)
+	}
+	forever.leases["gone"][0].Updated = time.Time{}
+	if expired, _ := forever.Expire(func(string) bool { return false }); len(expired) != 0 {
+		t.Errorf("a zero lease time expired %v", expired)
+	}
+}
+
+func TestNewPoolInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+	}{
+		{"no CIDR", nil},
+		{"invalid CIDR", []string{"10.108.0.0/33"}},
+		{"overlapping CIDRs", []string{"10.108.0.0/16", "10.108.1.0/24"}},
+	}
+	for _, test := range tests {
+		if _, err := NewPool(test.cidrs, "", 0); err == nil {
+			t.Errorf("%s: created a pool", test.name)
+		}
+	}
+}
+
+func TestAllocateRollsBack(t *testing.T) {
+	// The IPv4 CIDR has room but the IPv6 /127 has none left once the server takes fd00::1
+	pool, err := NewPool([]string{"10.108.0.0/29", "fd00::/127"}, "", 0, netip.MustParseAddr("fd00::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Allocate("alice"); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("got %v, want %v", err, ErrPoolExhausted)
+	}
+	if leases := pool.Leases(); len(leases) != 0 {
+		t.Errorf("refused client left leases %v behind", leases)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	pool, err := NewPool([]string{"10.108.0.0/24", "fd00::/64"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Allocate("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("phone", netip.MustParseAddr("10.108.0.10")); err != nil {
+		t.Fatal(err)
+	}
+	before := pool.Lookup("laptop")
+
+	tests := []struct {
+		name  string
+		addrs []string
+	}{
+		{"leased to another client", []string{"fd00::5", "10.108.0.10"}},
+		{"outside the pool", []string{"10.109.0.5"}},
+		{"two in one CIDR", []string{"10.108.0.5", "10.108.0.6"}},
+	}
+	for _, test := range tests {
+		var addrs []netip.Addr
+		for _, addr := range test.addrs {
+			addrs = append(addrs, netip.MustParseAddr(addr))
+		}
+		if err := pool.Replace("laptop", addrs); err == nil {
+			t.Errorf("%s: replaced", test.name)
+		}
+		if leases := pool.Lookup("laptop"); !reflect.DeepEqual(leases, before) {
+			t.Errorf("%s: leases changed to %v", test.name, leases)
+		}
+	}
+
+	if err := pool.Replace("laptop", []netip.Addr{netip.MustParseAddr("10.108.0.5")}); err != nil {
+		t.Fatal(err)
+	}
+	if leases := pool.Lookup("laptop"); len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.5") {
+		t.Errorf("laptop holds %v, want only 10.108.0.5", leases)
+	}
+}
@@ -0,0 +1,87 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+)
+
+// OuterHeaderLen is the IPv6 and UDP header every tunnel packet is wrapped in. IPv4 headers
+// are smaller, so an MTU worked out with it fits either.
+const OuterHeaderLen = 40 + 8
+
+// TunnelMTU returns the configured MTU. In auto mode, an MTU of 0, it is derived from the MTU
+// of the interface towards the servers, or of the default route on a server, minus overhead.
+func TunnelMTU(cfg *config.Config, overhead int) (int, error) {
+	if cfg.MTU != 0 {
+		return cfg.MTU, nil
+	}
+
+	var dsts []net.IP
+	if !cfg.ServerMode {
+		endpoints, err := utils.ResolveEndpoints(utils.SplitAddressList(cfg.ServerAddress))
+		if err != nil {
+			return 0, err
+		}
+		for _, endpoint := range endpoints {
+			dsts = append(dsts, endpoint.Addr().AsSlice())
+		}
+	}
+	egressMTU, err := EgressMTU(dsts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to derive the MTU: %w", err)
+	}
+	mtu := egressMTU - overhead
+	if mtu < 576 {
+		return 0, fmt.Errorf("egress MTU %d leaves only %d bytes for the tunnel, set the MTU explicitly", egressMTU, mtu)
+	}
+	log.Printf("Using MTU %d, the egress MTU %d minus %d bytes of tunnel overhead", mtu, egressMTU, overhead)
+	return mtu, nil
+}
+
+// EgressMTU returns the smallest MTU of the interfaces that traffic to dsts leaves through,
+// or of the interfaces holding a default route when dsts is empty
+func EgressMTU(dsts []net.IP) (int, error) {
+	var linkIndexes []int
+	if len(dsts) == 0 {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return 0, err
+		}
+		for _, route := range routes {
+			if route.Dst == nil {
+				linkIndexes = append(linkIndexes, route.LinkIndex)
+			} else if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+				linkIndexes = append(linkIndexes, route.LinkIndex)
+			}
+		}
+	}
+	for _, dst := range dsts {
+		routes, err := netlink.RouteGet(dst)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up the route to %s: %w", dst, err)
+		}
+		for _, route := range routes {
+			linkIndexes = append(linkIndexes, route.LinkIndex)
+		}
+	}
+
+	mtu := 0
+	for _, index := range linkIndexes {
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return 0, err
+		}
+		if linkMTU := link.Attrs().MTU; mtu == 0 || linkMTU < mtu {
+			mtu = linkMTU
+		}
+	}
+	if mtu == 0 {
+		return 0, errors.New("no egress interface found")
+	}
+	return mtu, nil
+}
@@ -0,0 +1,107 @@
+package netconf
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"syscall"
+)
+
+// RuleAdd installs rule and records its removal
+func (u *Undo) RuleAdd(rule *netlink.Rule) error {
+	if err := netlink.RuleAdd(rule); err != nil {
+		return err
+	}
+	u.Push(fmt.Sprintf("rule %s", describeRule(rule)), func() error {
+		return netlink.RuleDel(rule)
+	})
+	return nil
+}
+
+// AddPolicyRules sends all traffic without fwmark through table, the same way wg-quick does,
+// for every address family used by routes. The tunnel's own socket carries the mark so its
+// packets keep using the main table. A second rule consults the main table first while
+// ignoring its default routes, so local networks and more specific routes keep working.
+func (u *Undo) AddPolicyRules(table, fwmark int, routes []*net.IPNet) error {
+	for _, family := range families(routes) {
+		tunnelRule := netlink.NewRule()
+		tunnelRule.Family = family
+		tunnelRule.Table = table
+		tunnelRule.Mark = fwmark
+		tunnelRule.Invert = true
+		if err := u.RuleAdd(tunnelRule); err != nil {
+			return fmt.Errorf("failed to add rule for table %d: %w", table, err)
+		}
+
+		suppressRule := netlink.NewRule()
+		suppressRule.Family = family
+		suppressRule.Table = unix.RT_TABLE_MAIN
+		suppressRule.SuppressPrefixlen = 0
+		if err := u.RuleAdd(suppressRule); err != nil {
+			return fmt.Errorf("failed to add rule for the main table: %w", err)
+		}
+		log.Printf("Added policy rules sending unmarked %s traffic through table %d", familyName(family), table)
+	}
+	return nil
+}
+
+// MarkSocket returns a net.Dialer Control function that sets fwmark on the socket
+func MarkSocket(fwmark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, fwmark)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("failed to set fwmark on socket: %w", sockErr)
+		}
+		return nil
+	}
+}
+
+func families(routes []*net.IPNet) []int {
+	var hasIPv4, hasIPv6 bool
+	for _, route := range routes {
+		if route.IP.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	var result []int
+	if hasIPv4 {
+		result = append(result, netlink.FAMILY_V4)
+	}
+	if hasIPv6 {
+		result = append(result, netlink.FAMILY_V6)
+	}
+	return result
+}
+
+func familyName(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func describeRule(rule *netlink.Rule) string {
+	description := familyName(rule.Family)
+	if rule.Mark >= 0 {
+		if rule.Invert {
+			description += " not"
+		}
+		description += fmt.Sprintf(" fwmark %#x", rule.Mark)
+	}
+	description += fmt.Sprintf(" table %d", rule.Table)
+	if rule.SuppressPrefixlen >= 0 {
+		description += fmt.Sprintf(" suppress_prefixlength %d", rule.SuppressPrefixlen)
+	}
+	return description
+}
@@ -0,0 +1,266 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"syscall"
+)
+
+// ClientRoutes returns the prefixes a client sends through the tunnel: the configured routes,
+// plus the default route of every tunnel address family in global mode, minus the exclusions
+func ClientRoutes(cfg *config.Config, tunnelIPs []string) ([]*net.IPNet, error) {
+	include := cfg.Routes
+	if cfg.Global {
+		include = nil
+		for _, defaultDst := range utils.DefaultRoutes(tunnelIPs) {
+			include = append(include, defaultDst.String())
+		}
+	}
+	return SplitTunnel(include, cfg.ExcludedRoutes)
+}
+
+// SplitTunnel computes the prefixes to route through the tunnel: every include prefix with
+// the exclude prefixes carved out of it. Bare addresses are treated as single hosts.
+//
+// Excluding 10.0.0.0/8 from 0.0.0.0/0 for example yields 0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8,
+// 12.0.0.0/6 and so on, leaving traffic to 10.0.0.0/8 on the host's own routes.
+func SplitTunnel(include []string, exclude []string) ([]*net.IPNet, error) {
+	includePrefixes, err := parsePrefixes(include)
+	if err != nil {
+		return nil, err
+	}
+	excludePrefixes, err := parsePrefixes(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []netip.Prefix
+	for _, prefix := range includePrefixes {
+		routes = append(routes, subtract(prefix, excludePrefixes)...)
+	}
+	routes = dropCovered(routes)
+
+	ipNets := make([]*net.IPNet, 0, len(routes))
+	for _, route := range routes {
+		ipNets = append(ipNets, &net.IPNet{
+			IP:   route.Addr().AsSlice(),
+			Mask: net.CIDRMask(route.Bits(), route.Addr().BitLen()),
+		})
+	}
+	return ipNets, nil
+}
+
+// DiffRoutes returns the routes in next that are not in current, and those in current that
+// are not in next
+func DiffRoutes(current, next []*net.IPNet) (added []*net.IPNet, removed []*net.IPNet) {
+	inCurrent := map[string]bool{}
+	for _, route := range current {
+		inCurrent[route.String()] = true
+	}
+	inNext := map[string]bool{}
+	for _, route := range next {
+		inNext[route.String()] = true
+		if !inCurrent[route.String()] {
+			added = append(added, route)
+		}
+	}
+	for _, route := range current {
+		if !inNext[route.String()] {
+			removed = append(removed, route)
+		}
+	}
+	return added, removed
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range list {
+		ipNet, err := utils.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %s: %w", entry, err)
+		}
+		addr, _ := netip.AddrFromSlice(ipNet.IP)
+		bits, _ := ipNet.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), bits))
+	}
+	return prefixes, nil
+}
+
+// subtract removes every exclude prefix from prefix by splitting it in halves until the
+// pieces either fall entirely outside the excludes or entirely inside one of them
+func subtract(prefix netip.Prefix, exclude []netip.Prefix) []netip.Prefix {
+	for _, excluded := range exclude {
+		if !excluded.Overlaps(prefix) {
+			continue
+		}
+		if excluded.Bits() <= prefix.Bits() {
+			// The exclusion covers the whole prefix
+			return nil
+		}
+		lower, upper := halves(prefix)
+		return append(subtract(lower, exclude), subtract(upper, exclude)...)
+	}
+	return []netip.Prefix{prefix}
+}
+
+func halves(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits() + 1
+	lower := netip.PrefixFrom(prefix.Addr(), bits)
+
+	upperAddr := prefix.Addr().AsSlice()
+	upperAddr[prefix.Bits()/8] |= 1 << (7 - prefix.Bits()%8)
+	addr, _ := netip.AddrFromSlice(upperAddr)
+	return lower, netip.PrefixFrom(addr, bits)
+}
+
+// dropCovered removes duplicates and prefixes already covered by a broader one in the list
+func dropCovered(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Bits() != prefixes[j].Bits() {
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		}
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+	var kept []netip.Prefix
+	for _, prefix := range prefixes {
+		covered := false
+		for _, broader := range kept {
+			if broader.Bits() <= prefix.Bits() && broader.Contains(prefix.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, prefix)
+		}
+	}
+	return kept
+}
+
+// PinEndpoints adds a host route for every server endpoint that falls within routes, via
+// whatever gateway outside tunnel currently reaches it, and drops the routes pinned by an
+// earlier call. Without it the tunnel's own packets to the server would be routed back into
+// the tunnel as soon as routes are installed. It must be called before the routes are added,
+// and again before redialling, since the gateway may have changed with the network.
+func (u *Undo) PinEndpoints(endpoints []netip.AddrPort, routes []*net.IPNet, tunnel netlink.Link) error {
+	// The old pins go first, or they would be found as the way to the servers
+	u.mu.Lock()
+	first := !u.pinned
+	u.pinned = true
+	u.mu.Unlock()
+	if first {
+		u.Push("routes pinned to the servers", u.unpin)
+	} else if err := u.unpin(); err != nil {
+		log.Printf("Failed to remove the routes pinned to the servers: %v", err)
+	}
+
+	for _, endpoint := range endpoints {
+		ip := net.IP(endpoint.Addr().AsSlice())
+		if !containedIn(ip, routes) {
+			continue
+		}
+		if err := u.pinHostRoute(ip, tunnel); err != nil {
+			return fmt.Errorf("failed to pin route to server %s: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+func (u *Undo) pinHostRoute(ip net.IP, tunnel netlink.Link) error {
+	current, err := routeAvoiding(ip, tunnel)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		LinkIndex: current.LinkIndex,
+		Dst:       utils.HostPrefix(ip),
+		Gw:        current.Gw,
+	}
+	err = netlink.RouteAdd(route)
+	if errors.Is(err, syscall.EEXIST) {
+		log.Printf("Route to server %s already present", ip)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.pins = append(u.pins, route)
+	u.mu.Unlock()
+	log.Printf("Pinned route to server %s", describeRoute(route))
+	return nil
+}
+
+// unpin removes the routes pinned to the servers
+func (u *Undo) unpin() error {
+	u.mu.Lock()
+	pins := u.pins
+	u.pins = nil
+	u.mu.Unlock()
+	var failed error
+	for _, pin := range pins {
+		if err := netlink.RouteDel(pin); err != nil && !alreadyGone(err) {
+			failed = fmt.Errorf("route %s: %w", describeRoute(pin), err)
+		}
+	}
+	return failed
+}
+
+// routeAvoiding returns the route the kernel would take to ip if it were not for the routes
+// through tunnel: the most specific one of the main table, with the lowest metric
+func routeAvoiding(ip net.IP, tunnel netlink.Link) (*netlink.Route, error) {
+	current, err := netlink.RouteGet(ip)
+	if err != nil {
+		return nil, err
+	}
+	if len(current) > 0 && (tunnel == nil || current[0].LinkIndex != tunnel.Attrs().Index) {
+		return &current[0], nil
+	}
+
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+	var best *netlink.Route
+	bestBits := -1
+	for i := range routes {
+		route := &routes[i]
+		if tunnel != nil && route.LinkIndex == tunnel.Attrs().Index {
+			continue
+		}
+		bits := 0
+		if route.Dst != nil {
+			if !route.Dst.Contains(ip) {
+				continue
+			}
+			bits, _ = route.Dst.Mask.Size()
+		}
+		if bits > bestBits || bits == bestBits && route.Priority < best.Priority {
+			best, bestBits = route, bits
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no route to %s outside the tunnel", ip)
+	}
+	return best, nil
+}
+
+func containedIn(ip net.IP, routes []*net.IPNet) bool {
+	for _, route := range routes {
+		if route.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
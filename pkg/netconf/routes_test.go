@@ -0,0 +1,131 @@
+package netconf
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestSplitTunnel(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "nothing excluded",
+			include: []string{"10.0.0.0/8", "192.168.1.0/24"},
+			want:    []string{"10.0.0.0/8", "192.168.1.0/24"},
+		},
+		{
+			name:    "bare addresses are hosts",
+			include: []string{"1.1.1.1", "2001:db8::1"},
+			want:    []string{"1.1.1.1/32", "2001:db8::1/128"},
+		},
+		{
+			name:    "host bits are masked",
+			include: []string{"10.1.2.3/8"},
+			want:    []string{"10.0.0.0/8"},
+		},
+		{
+			name:    "exclusion carved out of the default route",
+			include: []string{"0.0.0.0/0"},
+			exclude: []string{"10.0.0.0/8"},
+			want: []string{
+				"128.0.0.0/1", "64.0.0.0/2", "32.0.0.0/3", "16.0.0.0/4",
+				"0.0.0.0/5", "12.0.0.0/6", "8.0.0.0/7", "11.0.0.0/8",
+			},
+		},
+		{
+			name:    "exclusion of a single host",
+			include: []string{"192.168.1.0/30"},
+			exclude: []string{"192.168.1.1"},
+			want:    []string{"192.168.1.2/31", "192.168.1.0/32"},
+		},
+		{
+			name:    "exclusion covering the whole include",
+			include: []string{"10.1.0.0/16"},
+			exclude: []string{"10.0.0.0/8"},
+			want:    []string{},
+		},
+		{
+			name:    "exclusion of the other family",
+			include: []string{"10.0.0.0/8"},
+			exclude: []string{"::/0"},
+			want:    []string{"10.0.0.0/8"},
+		},
+		{
+			name:    "ipv6 exclusion",
+			include: []string{"2001:db8::/32"},
+			exclude: []string{"2001:db8:8000::/33"},
+			want:    []string{"2001:db8::/33"},
+		},
+		{
+			name:    "duplicates and covered prefixes dropped",
+			include: []string{"10.1.0.0/16", "10.0.0.0/8", "10.0.0.0/8"},
+			want:    []string{"10.0.0.0/8"},
+		},
+	}
+	for _, test := range tests {
+		routes, err := SplitTunnel(test.include, test.exclude)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, route := range routes {
+			got = append(got, route.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitTunnelInvalid(t *testing.T) {
+	if _, err := SplitTunnel([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("invalid include accepted")
+	}
+	if _, err := SplitTunnel([]string{"0.0.0.0/0"}, []string{"example.com"}); err == nil {
+		t.Error("invalid exclude accepted")
+	}
+}
+
+// TestSubtractCoverage checks that subtract leaves exactly the addresses outside the excludes
+func TestSubtractCoverage(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	exclude := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.17/32"),
+		netip.MustParsePrefix("10.0.0.64/27"),
+		netip.MustParsePrefix("10.0.0.200/29"),
+	}
+	pieces := subtract(prefix, exclude)
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		excluded := false
+		for _, excludedPrefix := range exclude {
+			excluded = excluded || excludedPrefix.Contains(addr)
+		}
+		covering := 0
+		for _, piece := range pieces {
+			if piece.Contains(addr) {
+				covering++
+			}
+		}
+		if excluded && covering != 0 || !excluded && covering != 1 {
+			t.Fatalf("%s is covered by %d pieces of %v, excluded %t", addr, covering, pieces, excluded)
+		}
+	}
+}
+
+func TestDiffRoutes(t *testing.T) {
+	current, _ := SplitTunnel([]string{"10.0.0.0/8", "192.168.1.0/24"}, nil)
+	next, _ := SplitTunnel([]string{"192.168.1.0/24", "172.16.0.0/12"}, nil)
+	added, removed := DiffRoutes(current, next)
+	if len(added) != 1 || added[0].String() != "172.16.0.0/12" {
+		t.Errorf("added %v, want [172.16.0.0/12]", added)
+	}
+	if len(removed) != 1 || removed[0].String() != "10.0.0.0/8" {
+		t.Errorf("removed %v, want [10.0.0.0/8]", removed)
+	}
+}
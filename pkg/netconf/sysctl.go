@@ -0,0 +1,30 @@
+package netconf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetSysctl sets the kernel parameter name, e.g. net.ipv4.ip_forward, to value and records
+// restoring the value it had before. Nothing is recorded if it already had that value.
+func (u *Undo) SetSysctl(name, value string) error {
+	path := filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/"))
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read sysctl %s: %w", name, err)
+	}
+	if strings.TrimSpace(string(previous)) == value {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl %s: %w", name, err)
+	}
+	u.Push(fmt.Sprintf("sysctl %s", name), func() error {
+		return os.WriteFile(path, previous, 0644)
+	})
+	log.Printf("Set sysctl %s = %s", name, value)
+	return nil
+}
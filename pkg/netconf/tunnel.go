@@ -0,0 +1,150 @@
+package netconf
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"net/netip"
+)
+
+// TunnelRoutes installs the client routes through the tunnel and keeps track of them, so that
+// routes changed at runtime or on reload only touch what differs. It does no locking of its
+// own: callers hold their transport's configuration lock around it.
+type TunnelRoutes struct {
+	config *config.Config
+	undo   *Undo
+	// servers returns the server endpoints to keep off the tunnel
+	servers func() ([]netip.AddrPort, error)
+	routes  []*net.IPNet
+}
+
+// NewTunnelRoutes tracks the routes through cfg.TunName, recording the changes in undo.
+// servers is asked for the server endpoints whenever their host routes are pinned.
+func NewTunnelRoutes(cfg *config.Config, undo *Undo, servers func() ([]netip.AddrPort, error)) *TunnelRoutes {
+	return &TunnelRoutes{config: cfg, undo: undo, servers: servers}
+}
+
+// Routes returns the routes currently through the tunnel
+func (t *TunnelRoutes) Routes() []*net.IPNet {
+	return append([]*net.IPNet(nil), t.routes...)
+}
+
+// Strings returns the routes currently through the tunnel in CIDR notation
+func (t *TunnelRoutes) Strings() []string {
+	var routes []string
+	for _, route := range t.routes {
+		routes = append(routes, route.String())
+	}
+	return routes
+}
+
+// Add routes dsts through the tunnel, after pinning the server addresses they cover
+func (t *TunnelRoutes) Add(dsts []*net.IPNet) error {
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+	return t.add(link, dsts)
+}
+
+// Set installs and withdraws routes so that exactly next goes through the tunnel
+func (t *TunnelRoutes) Set(next []*net.IPNet) error {
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+
+	added, removed := DiffRoutes(t.routes, next)
+	for _, dst := range removed {
+		err := netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Table: t.config.RouteTable})
+		if err != nil {
+			return fmt.Errorf("failed to remove route for %s: %w", dst, err)
+		}
+		log.Printf("Removed route for %s through the VPN", dst)
+	}
+	// Keep the routes that stay, add records the added ones
+	t.routes, _ = DiffRoutes(added, next)
+	return t.add(link, added)
+}
+
+// AddRoute routes dst through the tunnel on top of the current routes
+func (t *TunnelRoutes) AddRoute(dst string) error {
+	prefix, err := utils.ParsePrefix(dst)
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %w", dst, err)
+	}
+	return t.Set(append(t.Routes(), prefix))
+}
+
+// RemoveRoute stops routing dst through the tunnel
+func (t *TunnelRoutes) RemoveRoute(dst string) error {
+	prefix, err := utils.ParsePrefix(dst)
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %w", dst, err)
+	}
+	var kept []*net.IPNet
+	for _, route := range t.routes {
+		if route.String() != prefix.String() {
+			kept = append(kept, route)
+		}
+	}
+	return t.Set(kept)
+}
+
+// Pin pins host routes to the servers covered by routes through whatever gateway reaches them
+// now, replacing the earlier pins. With policy routing the marked socket keeps the tunnel's
+// own traffic off the tunnel instead, so nothing is pinned.
+func (t *TunnelRoutes) Pin(routes []*net.IPNet) error {
+	if t.config.RouteTable != 0 || len(routes) == 0 {
+		return nil
+	}
+	link, err := t.link()
+	if err != nil {
+		return err
+	}
+	return t.pin(link, routes)
+}
+
+func (t *TunnelRoutes) add(link netlink.Link, dsts []*net.IPNet) error {
+	if t.config.RouteTable == 0 {
+		if err := t.pin(link, append(t.Routes(), dsts...)); err != nil {
+			return err
+		}
+	}
+	for _, dst := range dsts {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dst,
+			Table:     t.config.RouteTable,
+		}
+		if t.config.Global {
+			// Lower metric to override existing default routes
+			route.Priority = 50
+		}
+		if err := t.undo.RouteAdd(route); err != nil {
+			return fmt.Errorf("failed to add route for %s: %w", dst, err)
+		}
+		t.routes = append(t.routes, dst)
+		log.Printf("Added route for %s through the VPN", dst)
+	}
+	return nil
+}
+
+func (t *TunnelRoutes) pin(link netlink.Link, routes []*net.IPNet) error {
+	endpoints, err := t.servers()
+	if err != nil {
+		return err
+	}
+	return t.undo.PinEndpoints(endpoints, routes, link)
+}
+
+func (t *TunnelRoutes) link() (netlink.Link, error) {
+	link, err := netlink.LinkByName(t.config.TunName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TUN interface %s: %w", t.config.TunName, err)
+	}
+	return link, nil
+}
@@ -0,0 +1,112 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Undo records every change made to the host network configuration so that it can be
+// reverted in reverse order on shutdown or when startup fails half way through.
+type Undo struct {
+	mu    sync.Mutex
+	steps []step
+	// pins are the host routes to the servers, replaced as a whole by PinEndpoints
+	pins   []*netlink.Route
+	pinned bool
+}
+
+type step struct {
+	description string
+	revert      func() error
+}
+
+// Push records a change along with the function that reverts it
+func (u *Undo) Push(description string, revert func() error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.steps = append(u.steps, step{description: description, revert: revert})
+}
+
+// Run reverts every recorded change, newest first. It carries on past failures so one stuck
+// change does not leave the rest in place, and reports all of them together.
+func (u *Undo) Run() error {
+	u.mu.Lock()
+	steps := u.steps
+	u.steps = nil
+	u.mu.Unlock()
+
+	var failures []string
+	for i := len(steps) - 1; i >= 0; i-- {
+		err := steps[i].revert()
+		if err != nil && !alreadyGone(err) {
+			failures = append(failures, fmt.Sprintf("%s: %v", steps[i].description, err))
+			continue
+		}
+		log.Printf("Reverted %s", steps[i].description)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to revert network changes: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// AddrAdd assigns addr to link and records its removal
+func (u *Undo) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return err
+	}
+	u.Push(fmt.Sprintf("address %s on %s", addr.IPNet, link.Attrs().Name), func() error {
+		return netlink.AddrDel(link, addr)
+	})
+	return nil
+}
+
+// LinkSetUp brings link up and records bringing it back down
+func (u *Undo) LinkSetUp(link netlink.Link) error {
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	u.Push(fmt.Sprintf("link %s up", link.Attrs().Name), func() error {
+		return netlink.LinkSetDown(link)
+	})
+	return nil
+}
+
+// RouteAdd installs route and records its removal
+func (u *Undo) RouteAdd(route *netlink.Route) error {
+	if err := netlink.RouteAdd(route); err != nil {
+		return err
+	}
+	u.Push(fmt.Sprintf("route %s", describeRoute(route)), func() error {
+		return netlink.RouteDel(route)
+	})
+	return nil
+}
+
+// alreadyGone reports whether a revert failed only because the change no longer exists,
+// e.g. the address was replaced after a reconnect or the interface disappeared
+func alreadyGone(err error) bool {
+	return errors.Is(err, syscall.ESRCH) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func describeRoute(route *netlink.Route) string {
+	description := "default"
+	if route.Dst != nil {
+		description = route.Dst.String()
+	}
+	if route.Gw != nil {
+		description += " via " + route.Gw.String()
+	}
+	if route.Table != 0 {
+		description += fmt.Sprintf(" table %d", route.Table)
+	}
+	return description
+}
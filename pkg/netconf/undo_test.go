@@ -0,0 +1,68 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUndoRunNewestFirst(t *testing.T) {
+	var undo Undo
+	var reverted []string
+	for _, change := range []string{"address", "link up", "route"} {
+		change := change
+		undo.Push(change, func() error {
+			reverted = append(reverted, change)
+			return nil
+		})
+	}
+	if err := undo.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"route", "link up", "address"}; !reflect.DeepEqual(reverted, want) {
+		t.Errorf("reverted %v, want %v", reverted, want)
+	}
+
+	// Every change is reverted only once
+	reverted = nil
+	if err := undo.Run(); err != nil || len(reverted) != 0 {
+		t.Errorf("second run reverted %v, %v", reverted, err)
+	}
+}
+
+func TestUndoRunCarriesOnPastFailures(t *testing.T) {
+	var undo Undo
+	var reverted []string
+	revert := func(change string, err error) {
+		undo.Push(change, func() error {
+			reverted = append(reverted, change)
+			return err
+		})
+	}
+	revert("address", nil)
+	revert("stuck route", errors.New("device busy"))
+	revert("vanished route", fmt.Errorf("route delete: %w", syscall.ESRCH))
+	revert("link up", syscall.ENODEV)
+	revert("stuck rule", syscall.EPERM)
+
+	err := undo.Run()
+	if want := []string{"stuck rule", "link up", "vanished route", "stuck route", "address"}; !reflect.DeepEqual(reverted, want) {
+		t.Errorf("reverted %v, want %v", reverted, want)
+	}
+	if err == nil {
+		t.Fatal("failures not reported")
+	}
+	for _, want := range []string{"stuck rule: operation not permitted", "stuck route: device busy"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is missing from %v", want, err)
+		}
+	}
+	for _, gone := range []string{"vanished route", "link up"} {
+		if strings.Contains(err.Error(), gone) {
+			t.Errorf("%s was already gone but reported in %v", gone, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+var (
+	ErrTruncated      = errors.New("packet truncated")
+	ErrInvalidVersion = errors.New("invalid IP version")
+	ErrInvalidHeader  = errors.New("invalid IP header")
+)
+
+// Protocol is the IP protocol number of the transport carried by a packet
+type Protocol uint8
+
+const (
+	ICMP   Protocol = 1
+	TCP    Protocol = 6
+	UDP    Protocol = 17
+	ICMPv6 Protocol = 58
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ICMP:
+		return "icmp"
+	case TCP:
+		return "tcp"
+	case UDP:
+		return "udp"
+	case ICMPv6:
+		return "icmpv6"
+	}
+	return fmt.Sprintf("proto-%d", uint8(p))
+}
+
+// Packet is the validated header of a raw IPv4 or IPv6 packet
+type Packet struct {
+	Version  int
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol Protocol
+	// TTL holds the IPv4 time to live or the IPv6 hop limit
+	TTL uint8
+	// Length is the total length of the packet as given by its header
+	Length int
+	// SrcPort and DstPort are only set for unfragmented (or first fragment) TCP and UDP packets
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Parse validates the IP header at the start of b and returns its fields.
+// It never reads past the end of b, so truncated or malformed input yields an error instead of a panic.
+func Parse(b []byte) (*Packet, error) {
+	if len(b) == 0 {
+		return nil, ErrTruncated
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return parseIPv4(b)
+	case 6:
+		return parseIPv6(b)
+	}
+	return nil, fmt.Errorf("%w %d", ErrInvalidVersion, b[0]>>4)
+}
+
+func parseIPv4(b []byte) (*Packet, error) {
+	if len(b) < ipv4HeaderLen {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than an IPv4 header", ErrTruncated, len(b))
+	}
+	headerLen := int(b[0]&0x0f) * 4
+	if headerLen < ipv4HeaderLen {
+		return nil, fmt.Errorf("%w: IPv4 header length %d", ErrInvalidHeader, headerLen)
+	}
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if totalLen < headerLen {
+		return nil, fmt.Errorf("%w: IPv4 total length %d is shorter than its header", ErrInvalidHeader, totalLen)
+	}
+	if totalLen > len(b) {
+		return nil, fmt.Errorf("%w: IPv4 total length %d, got %d bytes", ErrTruncated, totalLen, len(b))
+	}
+
+	p := &Packet{
+		Version:  4,
+		Src:      netip.AddrFrom4(*(*[4]byte)(b[12:16])),
+		Dst:      netip.AddrFrom4(*(*[4]byte)(b[16:20])),
+		Protocol: Protocol(b[9]),
+		TTL:      b[8],
+		Length:   totalLen,
+	}
+	fragmentOffset := binary.BigEndian.Uint16(b[6:8]) & 0x1fff
+	if fragmentOffset == 0 {
+		p.parsePorts(b[headerLen:totalLen])
+	}
+	return p, nil
+}
+
+func parseIPv6(b []byte) (*Packet, error) {
+	if len(b) < ipv6HeaderLen {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than an IPv6 header", ErrTruncated, len(b))
+	}
+	totalLen := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+	if totalLen > len(b) {
+		return nil, fmt.Errorf("%w: IPv6 total length %d, got %d bytes", ErrTruncated, totalLen, len(b))
+	}
+
+	p := &Packet{
+		Version: 6,
+		Src:     netip.AddrFrom16(*(*[16]byte)(b[8:24])),
+		Dst:     netip.AddrFrom16(*(*[16]byte)(b[24:40])),
+		TTL:     b[7],
+		Length:  totalLen,
+	}
+
+	// Walk the extension headers to find the transport protocol
+	next := b[6]
+	payload := b[ipv6HeaderLen:totalLen]
+	firstFragment := true
+	for {
+		var extensionLen int
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(payload) < 8 {
+				return nil, fmt.Errorf("%w: IPv6 extension header", ErrTruncated)
+			}
+			extensionLen = (int(payload[1]) + 1) * 8
+		case 44: // fragment
+			if len(payload) < 8 {
+				return nil, fmt.Errorf("%w: IPv6 fragment header", ErrTruncated)
+			}
+			extensionLen = 8
+			firstFragment = binary.BigEndian.Uint16(payload[2:4])>>3 == 0
+		case 51: // authentication header
+			if len(payload) < 8 {
+				return nil, fmt.Errorf("%w: IPv6 authentication header", ErrTruncated)
+			}
+			extensionLen = (int(payload[1]) + 2) * 4
+		default:
+			p.Protocol = Protocol(next)
+			if firstFragment {
+				p.parsePorts(payload)
+			}
+			return p, nil
+		}
+		if extensionLen > len(payload) {
+			return nil, fmt.Errorf("%w: IPv6 extension header length %d", ErrTruncated, extensionLen)
+		}
+		next = payload[0]
+		payload = payload[extensionLen:]
+	}
+}
+
+func (p *Packet) parsePorts(transport []byte) {
+	if (p.Protocol != TCP && p.Protocol != UDP) || len(transport) < 4 {
+		return
+	}
+	p.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+	p.DstPort = binary.BigEndian.Uint16(transport[2:4])
+}
+
+func (p *Packet) String() string {
+	if p.SrcPort != 0 || p.DstPort != 0 {
+		return fmt.Sprintf("%s %s -> %s",
+			p.Protocol, netip.AddrPortFrom(p.Src, p.SrcPort), netip.AddrPortFrom(p.Dst, p.DstPort))
+	}
+	return fmt.Sprintf("%s %s -> %s", p.Protocol, p.Src, p.Dst)
+}
@@ -0,0 +1,162 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// ipv4 builds an IPv4 packet with a 20 byte header around payload
+func ipv4(protocol Protocol, fragmentOffset uint16, payload []byte) []byte {
+	b := make([]byte, ipv4HeaderLen+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[6:8], fragmentOffset)
+	b[8] = 64
+	b[9] = byte(protocol)
+	copy(b[12:16], []byte{10, 108, 0, 2})
+	copy(b[16:20], []byte{1, 1, 1, 1})
+	copy(b[ipv4HeaderLen:], payload)
+	return b
+}
+
+// ipv6 builds an IPv6 packet whose payload starts with the header next
+func ipv6(next byte, payload []byte) []byte {
+	b := make([]byte, ipv6HeaderLen+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	src := netip.MustParseAddr("fd00::2").As16()
+	dst := netip.MustParseAddr("2001:db8::1").As16()
+	copy(b[8:24], src[:])
+	copy(b[24:40], dst[:])
+	copy(b[ipv6HeaderLen:], payload)
+	return b
+}
+
+// ports is the start of a TCP or UDP header from port 40000 to 443
+var ports = []byte{0x9c, 0x40, 0x01, 0xbb, 0, 0, 0, 0}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		version int
+		src     string
+		dst     string
+		proto   Protocol
+		srcPort uint16
+		dstPort uint16
+	}{
+		{
+			name: "ipv4 udp", b: ipv4(UDP, 0, ports),
+			version: 4, src: "10.108.0.2", dst: "1.1.1.1", proto: UDP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name: "ipv4 tcp with trailing bytes", b: append(ipv4(TCP, 0, ports), 0, 0, 0),
+			version: 4, src: "10.108.0.2", dst: "1.1.1.1", proto: TCP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name: "ipv4 icmp", b: ipv4(ICMP, 0, []byte{8, 0, 0, 0}),
+			version: 4, src: "10.108.0.2", dst: "1.1.1.1", proto: ICMP,
+		},
+		{
+			name: "ipv4 non-first fragment", b: ipv4(UDP, 185, ports),
+			version: 4, src: "10.108.0.2", dst: "1.1.1.1", proto: UDP,
+		},
+		{
+			name: "ipv4 first fragment", b: ipv4(UDP, 0x2000, ports),
+			version: 4, src: "10.108.0.2", dst: "1.1.1.1", proto: UDP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name: "ipv6 tcp", b: ipv6(byte(TCP), ports),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: TCP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name:    "ipv6 udp after hop-by-hop and destination options",
+			b:       ipv6(0, append([]byte{60, 0, 0, 0, 0, 0, 0, 0, byte(UDP), 0, 0, 0, 0, 0, 0, 0}, ports...)),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: UDP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name: "ipv6 first fragment", b: ipv6(44, append([]byte{byte(UDP), 0, 0, 1, 0, 0, 0, 1}, ports...)),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: UDP, srcPort: 40000, dstPort: 443,
+		},
+		{
+			name: "ipv6 non-first fragment", b: ipv6(44, append([]byte{byte(UDP), 0, 0x05, 0xc9, 0, 0, 0, 1}, ports...)),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: UDP,
+		},
+		{
+			name: "ipv6 icmpv6", b: ipv6(byte(ICMPv6), []byte{128, 0, 0, 0}),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: ICMPv6,
+		},
+		{
+			name: "ipv6 tcp too short for ports", b: ipv6(byte(TCP), []byte{0x9c}),
+			version: 6, src: "fd00::2", dst: "2001:db8::1", proto: TCP,
+		},
+	}
+	for _, test := range tests {
+		p, err := Parse(test.b)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if p.Version != test.version || p.Src.String() != test.src || p.Dst.String() != test.dst ||
+			p.Protocol != test.proto || p.SrcPort != test.srcPort || p.DstPort != test.dstPort {
+			t.Errorf("%s: got version %d %s", test.name, p.Version, p)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	truncatedIPv4 := ipv4(UDP, 0, ports)
+	badIHL := ipv4(UDP, 0, ports)
+	badIHL[0] = 0x44
+	longerThanBuffer := ipv4(UDP, 0, ports)
+	binary.BigEndian.PutUint16(longerThanBuffer[2:4], 1500)
+	shorterThanHeader := ipv4(UDP, 0, ports)
+	binary.BigEndian.PutUint16(shorterThanHeader[2:4], 19)
+	optionsPastEnd := ipv4(UDP, 0, ports)
+	optionsPastEnd[0] = 0x4f
+	ipv6LongerThanBuffer := ipv6(byte(UDP), ports)
+	binary.BigEndian.PutUint16(ipv6LongerThanBuffer[4:6], 1500)
+
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"version 5", []byte{0x50, 0, 0, 0}, ErrInvalidVersion},
+		{"ipv4 shorter than its header", truncatedIPv4[:19], ErrTruncated},
+		{"ipv4 IHL below 5", badIHL, ErrInvalidHeader},
+		{"ipv4 total length beyond the buffer", longerThanBuffer, ErrTruncated},
+		{"ipv4 total length shorter than the header", shorterThanHeader, ErrInvalidHeader},
+		{"ipv4 options beyond the total length", optionsPastEnd, ErrInvalidHeader},
+		{"ipv6 shorter than its header", ipv6(byte(UDP), nil)[:39], ErrTruncated},
+		{"ipv6 payload length beyond the buffer", ipv6LongerThanBuffer, ErrTruncated},
+		{"ipv6 truncated hop-by-hop header", ipv6(0, []byte{byte(UDP), 0, 0, 0}), ErrTruncated},
+		{"ipv6 hop-by-hop length beyond the payload", ipv6(0, []byte{byte(UDP), 4, 0, 0, 0, 0, 0, 0}), ErrTruncated},
+		{"ipv6 truncated fragment header", ipv6(44, []byte{byte(UDP), 0, 0, 0}), ErrTruncated},
+		{"ipv6 truncated authentication header", ipv6(51, []byte{byte(UDP), 1, 0, 0}), ErrTruncated},
+		{"ipv6 chain running off the end", ipv6(0, []byte{60, 0, 0, 0, 0, 0, 0, 0}), ErrTruncated},
+	}
+	for _, test := range tests {
+		p, err := Parse(test.b)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, %v, want %v", test.name, p, err, test.want)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(ipv4(UDP, 0, ports))
+	f.Add(ipv6(0, append([]byte{44, 0, 0, 0, 0, 0, 0, 0, byte(TCP), 0, 0, 0, 0, 0, 0, 0}, ports...)))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := Parse(b)
+		if err == nil && p.Length > len(b) {
+			t.Errorf("length %d is beyond the %d bytes parsed", p.Length, len(b))
+		}
+	})
+}
@@ -1,8 +1,17 @@
 package vpn
 
-import "context"
+import (
+	"context"
+	"github.com/kwakubiney/safehaven/config"
+)
 
 type VPNService interface {
 	Start(ctx context.Context) error
 	Stop() error
 }
+
+// Reloader is implemented by VPN services that can apply a changed configuration without
+// tearing down the tunnel
+type Reloader interface {
+	Reload(cfg *config.Config) error
+}
@@ -0,0 +1,114 @@
+package plain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"github.com/kwakubiney/safehaven/utils"
+	"log"
+	"net/netip"
+)
+
+var _ control.Admin = (*PlainVPN)(nil)
+
+// AddPeer adds or updates a peer on the running server, reserving its tunnel addresses
+func (p *PlainVPN) AddPeer(peer config.Peer) error {
+	if !p.config.ServerMode {
+		return errors.New("peers can only be added in server mode")
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	peers := []config.Peer{peer}
+	for _, existing := range p.config.Peers {
+		if existing.ID != peer.ID {
+			peers = append(peers, existing)
+		}
+	}
+	if p.pool != nil {
+		var addrs []netip.Addr
+		for _, tunnelIP := range peer.TunnelIPs {
+			addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+			if err != nil {
+				return fmt.Errorf("invalid tunnel IP %s for peer %s: %w", tunnelIP, peer.ID, err)
+			}
+			addrs = append(addrs, addr)
+		}
+		// The peer keeps its old addresses unless all the new ones can be reserved
+		if err := p.pool.Replace(peer.ID, addrs); err != nil {
+			return fmt.Errorf("failed to reserve the tunnel IPs of peer %s: %w", peer.ID, err)
+		}
+	}
+	p.config.Peers = peers
+	log.Printf("Added peer %s with tunnel IPs %v", peer.ID, peer.TunnelIPs)
+	return nil
+}
+
+// RemovePeer releases the addresses reserved for a peer on the running server. A connected
+// client keeps its session until it reconnects.
+func (p *PlainVPN) RemovePeer(id string) error {
+	if !p.config.ServerMode {
+		return errors.New("peers can only be removed in server mode")
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	var peers []config.Peer
+	for _, existing := range p.config.Peers {
+		if existing.ID != id {
+			peers = append(peers, existing)
+		}
+	}
+	if len(peers) == len(p.config.Peers) {
+		return fmt.Errorf("no peer with id %s", id)
+	}
+	if p.pool != nil {
+		if err := p.pool.Release(id); err != nil {
+			return err
+		}
+	}
+	p.config.Peers = peers
+	log.Printf("Removed peer %s", id)
+	return nil
+}
+
+// AddRoute routes dst through the tunnel
+func (p *PlainVPN) AddRoute(dst string) error {
+	return p.changeRoutes(func() error {
+		return p.routes.AddRoute(dst)
+	})
+}
+
+// RemoveRoute stops routing dst through the tunnel
+func (p *PlainVPN) RemoveRoute(dst string) error {
+	return p.changeRoutes(func() error {
+		return p.routes.RemoveRoute(dst)
+	})
+}
+
+func (p *PlainVPN) changeRoutes(change func() error) error {
+	if p.config.ServerMode {
+		return errors.New("routes can only be changed on a client")
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	return change()
+}
+
+// Reconnect drops the connection to the server and dials again, which is also how the
+// client fails over to the next server
+func (p *PlainVPN) Reconnect() error {
+	if p.config.ServerMode {
+		return errors.New("only clients can reconnect")
+	}
+	if p.currentConn() == nil {
+		return errors.New("not connected to a server")
+	}
+	select {
+	case p.reconnect <- struct{}{}:
+	default:
+		// A reconnect is already pending
+	}
+	return nil
+}
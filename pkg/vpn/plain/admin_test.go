@@ -0,0 +1,118 @@
+package plain
+
+import (
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/ipam"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemovePeer(t *testing.T) {
+	pool, err := ipam.NewPool([]string{"10.108.0.0/24"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := config.Peer{ID: "laptop", TunnelIPs: []string{"10.108.0.5"}}
+	phone := config.Peer{ID: "phone", TunnelIPs: []string{"10.108.0.6"}}
+	p := &PlainVPN{config: &config.Config{ServerMode: true, Peers: []config.Peer{laptop, phone}}, pool: pool}
+	if err := p.reservePeers(p.config.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.RemovePeer("tablet"); err == nil {
+		t.Error("removed a peer that does not exist")
+	}
+	if err := p.RemovePeer("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.config.Peers, []config.Peer{phone}) {
+		t.Errorf("peers are %v, want only phone", p.config.Peers)
+	}
+	if leases := pool.Lookup("laptop"); len(leases) != 0 {
+		t.Errorf("removed peer still holds %v", leases)
+	}
+	// The address is free for anyone again
+	if err := pool.Reserve("tablet", netip.MustParseAddr("10.108.0.5")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdminModeChecks(t *testing.T) {
+	client := &PlainVPN{config: &config.Config{}, reconnect: make(chan struct{}, 1)}
+	if err := client.AddPeer(config.Peer{ID: "laptop"}); err == nil {
+		t.Error("client added a peer")
+	}
+	if err := client.RemovePeer("laptop"); err == nil {
+		t.Error("client removed a peer")
+	}
+	if err := client.Reconnect(); err == nil {
+		t.Error("client reconnected without a connection")
+	}
+	if _, err := client.Status(); err == nil {
+		t.Error("client reported a status without a connection")
+	}
+
+	server := &PlainVPN{config: &config.Config{ServerMode: true}}
+	if err := server.AddRoute("10.0.0.0/8"); err == nil {
+		t.Error("server added a route")
+	}
+	if err := server.RemoveRoute("10.0.0.0/8"); err == nil {
+		t.Error("server removed a route")
+	}
+	if err := server.Reconnect(); err == nil {
+		t.Error("server reconnected")
+	}
+}
+
+func TestReconnectCoalesces(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.Dial("udp", serverConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := &PlainVPN{config: &config.Config{}, reconnect: make(chan struct{}, 1)}
+	p.setConn(conn)
+	for i := 0; i < 3; i++ {
+		if err := p.Reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(p.reconnect) != 1 {
+		t.Errorf("%d reconnects pending, want them folded into one", len(p.reconnect))
+	}
+}
+
+func TestServerStatusAndStats(t *testing.T) {
+	p := &PlainVPN{config: &config.Config{ServerMode: true, TunName: "sh0", LocalAddress: "3000"}, sessions: NewSessionTable(time.Minute)}
+	endpoint := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 41000}
+	p.sessions.Open("alice", []string{"10.108.0.2/24"}, endpoint, nil)
+	p.stats.Replays.Add(2)
+
+	status, err := p.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Mode != "server" || status.Interface != "sh0" || status.ListenPort != 3000 || len(status.Peers) != 1 {
+		t.Fatalf("got status %+v", status)
+	}
+	if peer := status.Peers[0]; peer.ID != "alice" || peer.Endpoint != endpoint.String() || !reflect.DeepEqual(peer.AllowedIPs, []string{"10.108.0.2"}) {
+		t.Errorf("got peer %+v", peer)
+	}
+
+	stats, err := p.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["sessions"] != 1 || stats["replays"] != uint64(2) {
+		t.Errorf("got stats %v", stats)
+	}
+}
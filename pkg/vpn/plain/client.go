@@ -0,0 +1,502 @@
+package plain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/dns"
+	"github.com/kwakubiney/safehaven/pkg/firewall"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	handshakeAttempts = 3
+	handshakeTimeout  = 2 * time.Second
+
+	// A server is considered gone after this many keepalive intervals without hearing from it
+	deadKeepalives = 3
+
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+var (
+	errRejected  = errors.New("server rejected handshake")
+	errReconnect = errors.New("reconnect requested")
+)
+
+func (p *PlainVPN) startClient(ctx context.Context) error {
+	log.Println("Setting up TUN interface...")
+	err := p.setTunOnDevice()
+	if err != nil {
+		return err
+	}
+	log.Printf("TUN interface %s created successfully", p.config.TunName)
+
+	p.mtu, err = netconf.TunnelMTU(p.config, p.overhead())
+	if err != nil {
+		return err
+	}
+
+	if p.config.KillSwitch {
+		killSwitch, err := firewall.ClientKillSwitch(p.config)
+		if err != nil {
+			return err
+		}
+		if err := killSwitch.Enable(&p.undo); err != nil {
+			return err
+		}
+		p.killSwitch = killSwitch
+	}
+
+	clientConn, accepted, err := p.connect(ctx, true)
+	if err != nil {
+		return err
+	}
+	p.applyWelcome(accepted)
+
+	log.Println("Configuring TUN IP address...")
+	err = p.assignIPToTun()
+	if err != nil {
+		return err
+	}
+	log.Printf("TUN interface IP configured: %v", p.tunnelIPs)
+
+	log.Println("Setting up network routes...")
+	err = p.createRoutes()
+	if err != nil {
+		return err
+	}
+	if p.config.Global {
+		log.Println("Global routing enabled - all traffic will go through VPN")
+	} else {
+		log.Printf("Routes to %v configured through VPN", p.config.Routes)
+	}
+
+	if len(p.config.DNSForward) > 0 {
+		err = p.startDNSForwarder()
+	} else {
+		dnsSettings := dns.Settings{Servers: accepted.DNS, SearchDomains: accepted.SearchDomains, Default: p.config.Global}
+		if len(p.config.DNSServers) > 0 {
+			dnsSettings.Servers, dnsSettings.SearchDomains = p.config.DNSServers, p.config.SearchDomains
+		}
+		err = dns.Apply(&p.undo, p.config.TunName, dnsSettings)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to configure DNS: %w", err)
+	}
+
+	//send
+	p.wg.Add(1)
+	log.Println("Started send handler")
+	go func() {
+		defer p.wg.Done()
+		packet := make([]byte, 65535)
+		for {
+			select {
+			case <-ctx.Done():
+				fmt.Println("Exiting loop...")
+				return
+			default:
+				n, err := p.tunDevice.Read(packet[frameHeaderLen:])
+				if err != nil {
+					log.Printf("Error reading from TUN: %v", err)
+					break
+				}
+
+				putFrameHeader(packet, messageData)
+				_, err = p.currentConn().Write(p.seal(packet[:frameHeaderLen+n]))
+				if err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Printf("Error sending data: %v", err)
+					continue
+				}
+			}
+		}
+	}()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.maintainConnection(ctx, clientConn, accepted)
+	}()
+
+	// Wait for context cancellation
+	<-ctx.Done()
+	log.Println("VPN client shutting down...")
+	return nil
+}
+
+// maintainConnection serves the current connection until the path to the server dies,
+// then redials, rotating through the configured servers, until ctx is cancelled
+func (p *PlainVPN) maintainConnection(ctx context.Context, conn net.Conn, accepted *welcome) {
+	for {
+		err := p.serveConnection(ctx, conn, accepted)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Lost connection to VPN server %s: %v", conn.RemoteAddr(), err)
+
+		conn, accepted, err = p.connect(ctx, false)
+		if err != nil {
+			return
+		}
+		previous := p.applyWelcome(accepted)
+		if err := p.reconfigureTun(previous); err != nil {
+			log.Printf("Error reconfiguring TUN interface: %v", err)
+		}
+	}
+}
+
+// repinServers pins the routes to the servers again through whatever gateway reaches them
+// now, as the network may have changed since the tunnel routes were installed
+func (p *PlainVPN) repinServers() error {
+	p.configMu.RLock()
+	routes := p.routes.Routes()
+	p.configMu.RUnlock()
+	return p.routes.Pin(routes)
+}
+
+// serveConnection receives from conn and keeps it alive, returning once the server
+// says goodbye, has not been heard from for deadKeepalives keepalive intervals, or a
+// reconnect is requested
+func (p *PlainVPN) serveConnection(ctx context.Context, conn net.Conn, accepted *welcome) error {
+	var lastReceived atomic.Int64
+	lastReceived.Store(time.Now().UnixNano())
+	lost := make(chan error, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Println("Started receive handler")
+		datagram := make([]byte, 65535)
+		for {
+			n, err := conn.Read(datagram)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error receiving data: %v", err)
+				continue
+			}
+			sender, counter, frame, err := p.open(datagram[:n])
+			if err != nil || !p.accept(p.serverReplay, sender, counter) {
+				continue
+			}
+			t, payload, err := decodeFrame(frame)
+			if err != nil {
+				log.Printf("Dropping frame from server: %v", err)
+				continue
+			}
+			lastReceived.Store(time.Now().UnixNano())
+
+			switch t {
+			case messageData:
+				_, err = p.tunDevice.Write(payload)
+				if err != nil {
+					log.Printf("Error writing to TUN: %v", err)
+					continue
+				}
+			case messageKeepalive:
+			case messageBye:
+				lost <- errors.New("server closed the session")
+				return
+			case messageReject:
+				var refused reject
+				if err := decodeControl(t, payload, &refused); err != nil {
+					continue
+				}
+				lost <- fmt.Errorf("%w: %s", errRejected, refused.Reason)
+				return
+			default:
+				log.Printf("Ignoring unexpected %s message from server", t)
+			}
+		}
+	}()
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	interval := time.Duration(accepted.KeepaliveInterval) * time.Second
+	if interval <= 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-lost:
+			return err
+		case <-p.reconnect:
+			return errReconnect
+		}
+	}
+
+	message, err := encodeControl(messageKeepalive, keepalive{TunnelIP: utils.RemoveCIDRSuffix(p.tunnelIPs[0], "/")})
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-lost:
+			return err
+		case <-p.reconnect:
+			return errReconnect
+		case <-ticker.C:
+			silence := time.Since(time.Unix(0, lastReceived.Load()))
+			if silence > deadKeepalives*interval {
+				return fmt.Errorf("no response for %s", silence.Round(time.Second))
+			}
+			if _, err := conn.Write(p.seal(message)); err != nil {
+				log.Printf("Error sending keepalive: %v", err)
+			}
+		}
+	}
+}
+
+// connect dials the configured servers in turn until one accepts our handshake, backing
+// off exponentially after every full round. A rejection ends the attempt straight away
+// when failOnReject is set, which is what we want on startup.
+func (p *PlainVPN) connect(ctx context.Context, failOnReject bool) (net.Conn, *welcome, error) {
+	servers := utils.SplitAddressList(p.config.ServerAddress)
+	if p.killSwitch != nil {
+		// Name resolution is dropped by the kill switch, so dial the addresses it lets through
+		servers = nil
+		for _, endpoint := range p.killSwitch.Endpoints {
+			servers = append(servers, endpoint.String())
+		}
+	}
+	if len(servers) == 0 {
+		return nil, nil, errors.New("no server address configured")
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		server := servers[p.serverIndex%len(servers)]
+		if err := p.repinServers(); err != nil {
+			log.Printf("Failed to pin routes to the servers: %v", err)
+		}
+		conn, accepted, err := p.dialServer(ctx, server)
+		if err == nil {
+			p.setConn(conn)
+			return conn, accepted, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if failOnReject && errors.Is(err, errRejected) {
+			return nil, nil, err
+		}
+		log.Printf("Failed to connect to VPN server %s: %v", server, err)
+
+		p.serverIndex++
+		if attempt%len(servers) != 0 {
+			continue
+		}
+		log.Printf("Retrying in %s...", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (p *PlainVPN) dialServer(ctx context.Context, server string) (net.Conn, *welcome, error) {
+	log.Printf("Connecting to VPN server at %s...", server)
+	dialer := net.Dialer{}
+	if p.config.RouteTable != 0 {
+		dialer.Control = netconf.MarkSocket(p.config.FwMark)
+	}
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("Performing handshake with VPN server...")
+	accepted, err := p.handshake(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if len(accepted.TunnelIPs) == 0 {
+		conn.Close()
+		return nil, nil, errors.New("server did not assign a tunnel address")
+	}
+	log.Printf("Connected to VPN server %s successfully: tunnel IPs %v, server tunnel IPs %v, MTU %d",
+		server, accepted.TunnelIPs, accepted.ServerTunnelIPs, accepted.MTU)
+	return conn, accepted, nil
+}
+
+// handshake announces the client to the server and waits for it to be accepted
+func (p *PlainVPN) handshake(ctx context.Context, conn net.Conn) (*welcome, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate handshake nonce: %w", err)
+	}
+	request, err := encodeControl(messageHello, hello{
+		ClientID:  p.config.ClientID,
+		TunnelIPs: utils.SplitAddressList(p.config.ClientTunIP),
+		MTU:       p.mtu,
+		Nonce:     hex.EncodeToString(nonce),
+		Timestamp: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	request = p.seal(request)
+	defer conn.SetReadDeadline(time.Time{})
+
+	response := make([]byte, 65535)
+	for attempt := 1; attempt <= handshakeAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(request); err != nil {
+			log.Printf("Error sending hello (attempt %d/%d): %v", attempt, handshakeAttempts, err)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(handshakeTimeout):
+			}
+			continue
+		}
+
+		deadline := time.Now().Add(handshakeTimeout)
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for time.Now().Before(deadline) {
+			n, err := conn.Read(response)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				log.Printf("Error waiting for welcome (attempt %d/%d): %v", attempt, handshakeAttempts, err)
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(time.Until(deadline)):
+				}
+				break
+			}
+
+			sender, counter, frame, err := p.open(response[:n])
+			if err != nil {
+				log.Printf("Dropping datagram from server: %v", err)
+				continue
+			}
+			t, payload, err := decodeFrame(frame)
+			if err != nil {
+				log.Printf("Dropping frame from server: %v", err)
+				continue
+			}
+			switch t {
+			case messageWelcome:
+				var accepted welcome
+				if err := decodeControl(t, payload, &accepted); err != nil {
+					return nil, err
+				}
+				if accepted.Nonce != hex.EncodeToString(nonce) {
+					log.Println("Ignoring welcome for a different handshake")
+					continue
+				}
+				p.serverReplay = newReplayWindow(sender)
+				p.serverReplay.Accept(counter)
+				return &accepted, nil
+			case messageReject:
+				var refused reject
+				if err := decodeControl(t, payload, &refused); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("%w: %s", errRejected, refused.Reason)
+			}
+		}
+		log.Printf("No welcome from server (attempt %d/%d)", attempt, handshakeAttempts)
+	}
+	return nil, fmt.Errorf("no response from server %s after %d attempts", conn.RemoteAddr(), handshakeAttempts)
+}
+
+// startDNSForwarder serves split DNS on the first tunnel address
+func (p *PlainVPN) startDNSForwarder() error {
+	rules, err := dns.ParseRules(p.config.DNSForward)
+	if err != nil {
+		return err
+	}
+	p.configMu.RLock()
+	listenIP := net.ParseIP(utils.RemoveCIDRSuffix(p.tunnelIPs[0], "/"))
+	p.configMu.RUnlock()
+	return dns.Forward(&p.undo, p.config.TunName, listenIP, rules)
+}
+
+// applyWelcome takes on the tunnel addresses and MTU the server handed out, returning the
+// previous addresses. Only the connecting goroutine writes them, so it reads them unlocked.
+func (p *PlainVPN) applyWelcome(accepted *welcome) []string {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	previous := p.tunnelIPs
+	p.tunnelIPs = accepted.TunnelIPs
+	p.mtu = accepted.MTU
+	return previous
+}
+
+// reconfigureTun brings the TUN addresses and MTU in line with what the server handed
+// out on reconnection, which only differs if the server lost our lease
+func (p *PlainVPN) reconfigureTun(previous []string) error {
+	tunLink, err := netlink.LinkByName(p.config.TunName)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, tunnelIP := range p.tunnelIPs {
+		current[tunnelIP] = true
+	}
+	old := map[string]bool{}
+	for _, tunnelIP := range previous {
+		old[tunnelIP] = true
+		if current[tunnelIP] {
+			continue
+		}
+		addr, err := netlink.ParseAddr(tunnelIP)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrDel(tunLink, addr); err != nil {
+			return err
+		}
+		log.Printf("Removed tunnel address %s", tunnelIP)
+	}
+	for _, tunnelIP := range p.tunnelIPs {
+		if old[tunnelIP] {
+			continue
+		}
+		addr, err := netlink.ParseAddr(tunnelIP)
+		if err != nil {
+			return err
+		}
+		if err := p.undo.AddrAdd(tunLink, addr); err != nil {
+			return err
+		}
+		log.Printf("Added tunnel address %s", tunnelIP)
+	}
+
+	if p.mtu > 0 && tunLink.Attrs().MTU != p.mtu {
+		return netlink.LinkSetMTU(tunLink, p.mtu)
+	}
+	return nil
+}
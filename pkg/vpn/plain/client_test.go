@@ -0,0 +1,137 @@
+package plain
+
+import (
+	"context"
+	"errors"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer answers every hello with what answer returns for it, and counts the hellos
+func fakeServer(t *testing.T, answer func(request hello, n int) (messageType, interface{})) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hellos := &atomic.Int32{}
+	go func() {
+		datagram := make([]byte, 65535)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(datagram)
+			if err != nil {
+				return
+			}
+			_, payload, _ := decodeFrame(datagram[:n])
+			var request hello
+			if decodeControl(messageHello, payload, &request) != nil {
+				continue
+			}
+			messageType, message := answer(request, int(hellos.Add(1)))
+			frame, _ := encodeControl(messageType, message)
+			conn.WriteToUDP(frame, clientAddr)
+		}
+	}()
+	return conn.LocalAddr().String(), hellos
+}
+
+func rejecting(request hello, n int) (messageType, interface{}) {
+	return messageReject, reject{Reason: "client not allowed"}
+}
+
+func accepting(request hello, n int) (messageType, interface{}) {
+	return messageWelcome, welcome{Nonce: request.Nonce, TunnelIPs: request.TunnelIPs}
+}
+
+func connectingClient(servers string) *PlainVPN {
+	cfg := &config.Config{ClientID: "laptop", ClientTunIP: "10.108.0.7/24", ServerAddress: servers}
+	p := &PlainVPN{config: cfg, mtu: 1500}
+	p.routes = netconf.NewTunnelRoutes(cfg, &p.undo, nil)
+	return p
+}
+
+func TestConnectFailsOver(t *testing.T) {
+	first, firstHellos := fakeServer(t, rejecting)
+	second, secondHellos := fakeServer(t, rejecting)
+	third, _ := fakeServer(t, accepting)
+	p := connectingClient(first + "," + second + "," + third)
+
+	conn, accepted, err := p.connect(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != third || p.currentConn() != conn {
+		t.Errorf("connected to %s, want %s", conn.RemoteAddr(), third)
+	}
+	if accepted.TunnelIPs[0] != "10.108.0.7/24" {
+		t.Errorf("welcomed with %+v", accepted)
+	}
+	if firstHellos.Load() != 1 || secondHellos.Load() != 1 {
+		t.Errorf("the servers that rejected were tried %d and %d times, want once", firstHellos.Load(), secondHellos.Load())
+	}
+	if p.serverIndex != 2 {
+		t.Errorf("server index %d, want the third server to be dialled next", p.serverIndex)
+	}
+}
+
+func TestConnectFailsOnRejectAtStartup(t *testing.T) {
+	first, _ := fakeServer(t, rejecting)
+	second, secondHellos := fakeServer(t, accepting)
+	p := connectingClient(first + "," + second)
+	if _, _, err := p.connect(context.Background(), true); !errors.Is(err, errRejected) {
+		t.Errorf("got %v, want a rejection", err)
+	}
+	if secondHellos.Load() != 0 {
+		t.Error("failed over after a rejection on startup")
+	}
+}
+
+func TestConnectBacksOffAfterEveryRound(t *testing.T) {
+	server, hellos := fakeServer(t, func(request hello, n int) (messageType, interface{}) {
+		if n == 1 {
+			return rejecting(request, n)
+		}
+		return accepting(request, n)
+	})
+	p := connectingClient(server)
+
+	start := time.Now()
+	conn, _, err := p.connect(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed < initialBackoff {
+		t.Errorf("redialled after %s, want a backoff of %s", elapsed, initialBackoff)
+	}
+	if hellos.Load() != 2 {
+		t.Errorf("%d hellos, want 2", hellos.Load())
+	}
+}
+
+func TestConnectStopsWhileBackingOff(t *testing.T) {
+	server, _ := fakeServer(t, rejecting)
+	p := connectingClient(server)
+	ctx, cancel := context.WithTimeout(context.Background(), initialBackoff/4)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, err := p.connect(ctx, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed >= initialBackoff {
+		t.Errorf("took %s to stop", elapsed)
+	}
+}
+
+func TestConnectWithoutServers(t *testing.T) {
+	if _, _, err := connectingClient(" , ").connect(context.Background(), false); err == nil {
+		t.Error("connected without a server")
+	}
+}
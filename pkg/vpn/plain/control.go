@@ -0,0 +1,115 @@
+package plain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Every datagram on the plain transport starts with a two byte header: the protocol
+// version followed by the message type. Data messages carry a raw IP packet, control
+// messages carry a JSON payload.
+const (
+	protocolVersion = 1
+	frameHeaderLen  = 2
+)
+
+type messageType byte
+
+const (
+	messageData messageType = iota
+	messageHello
+	messageWelcome
+	messageKeepalive
+	messageBye
+	messageReject
+)
+
+func (t messageType) String() string {
+	switch t {
+	case messageData:
+		return "data"
+	case messageHello:
+		return "hello"
+	case messageWelcome:
+		return "welcome"
+	case messageKeepalive:
+		return "keepalive"
+	case messageBye:
+		return "bye"
+	case messageReject:
+		return "reject"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+var (
+	errShortFrame         = errors.New("frame too short")
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// hello is sent by the client to announce itself and ask for a tunnel address
+type hello struct {
+	ClientID  string   `json:"client_id"`
+	TunnelIPs []string `json:"tunnel_ips,omitempty"`
+	MTU       int      `json:"mtu"`
+	Nonce     string   `json:"nonce"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// welcome is the server's answer to an accepted hello
+type welcome struct {
+	Nonce             string   `json:"nonce"`
+	TunnelIPs         []string `json:"tunnel_ips"`
+	ServerTunnelIPs   []string `json:"server_tunnel_ips"`
+	MTU               int      `json:"mtu"`
+	KeepaliveInterval int      `json:"keepalive_interval"`
+	DNS               []string `json:"dns,omitempty"`
+	SearchDomains     []string `json:"search_domains,omitempty"`
+}
+
+// keepalive lets the server find the session of a client that roamed since its last packet
+type keepalive struct {
+	TunnelIP string `json:"tunnel_ip"`
+}
+
+// reject tells the client why its hello was refused
+type reject struct {
+	Reason string `json:"reason"`
+}
+
+// putFrameHeader writes the frame header into the start of frame
+func putFrameHeader(frame []byte, t messageType) {
+	frame[0] = protocolVersion
+	frame[1] = byte(t)
+}
+
+func encodeControl(t messageType, message interface{}) ([]byte, error) {
+	frame := make([]byte, frameHeaderLen)
+	putFrameHeader(frame, t)
+	if message == nil {
+		return frame, nil
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s message: %w", t, err)
+	}
+	return append(frame, payload...), nil
+}
+
+func decodeFrame(frame []byte) (messageType, []byte, error) {
+	if len(frame) < frameHeaderLen {
+		return 0, nil, errShortFrame
+	}
+	if frame[0] != protocolVersion {
+		return 0, nil, fmt.Errorf("%w %d", errUnsupportedVersion, frame[0])
+	}
+	return messageType(frame[1]), frame[frameHeaderLen:], nil
+}
+
+func decodeControl(t messageType, payload []byte, message interface{}) error {
+	if err := json.Unmarshal(payload, message); err != nil {
+		return fmt.Errorf("failed to decode %s message: %w", t, err)
+	}
+	return nil
+}
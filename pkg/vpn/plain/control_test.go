@@ -0,0 +1,211 @@
+package plain
+
+import (
+	"context"
+	"errors"
+	"github.com/kwakubiney/safehaven/config"
+	cmap "github.com/orcaman/concurrent-map/v2"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlRoundTrip(t *testing.T) {
+	sent := hello{ClientID: "laptop", TunnelIPs: []string{"10.108.0.7/24", "fd00::7/64"}, MTU: 1400, Nonce: "00ff", Timestamp: 42}
+	frame, err := encodeControl(messageHello, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageType, payload, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != messageHello {
+		t.Fatalf("decoded a %s message", messageType)
+	}
+	var received hello
+	if err := decodeControl(messageType, payload, &received); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("got %+v, want %+v", received, sent)
+	}
+
+	bye, err := encodeControl(messageBye, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType, payload, err := decodeFrame(bye); err != nil || messageType != messageBye || len(payload) != 0 {
+		t.Errorf("bye decoded as %s, %q, %v", messageType, payload, err)
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	if _, _, err := decodeFrame([]byte{protocolVersion}); !errors.Is(err, errShortFrame) {
+		t.Errorf("short frame: %v", err)
+	}
+	if _, _, err := decodeFrame([]byte{protocolVersion + 1, byte(messageHello)}); !errors.Is(err, errUnsupportedVersion) {
+		t.Errorf("unknown version: %v", err)
+	}
+	var received welcome
+	if err := decodeControl(messageWelcome, []byte("{"), &received); err == nil {
+		t.Error("truncated payload decoded")
+	}
+}
+
+// testServer answers hellos on a loopback socket the way a server without a pool does
+func testServer(t *testing.T, cipher *packetCipher) (*PlainVPN, string) {
+	t.Helper()
+	p := &PlainVPN{
+		config:    &config.Config{ServerMode: true, KeepaliveInterval: 10 * time.Second},
+		tunnelIPs: []string{"10.108.0.1/24"},
+		sessions:  NewSessionTable(time.Minute),
+		mtu:       1400,
+		cipher:    cipher,
+		lastHello: cmap.New[int64](),
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		datagram := make([]byte, 65535)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(datagram)
+			if err != nil {
+				return
+			}
+			sender, counter, frame, err := p.open(datagram[:n])
+			if err != nil {
+				continue
+			}
+			if messageType, payload, err := decodeFrame(frame); err == nil && messageType == messageHello {
+				p.handleHello(conn, clientAddr, sender, counter, payload)
+			}
+		}
+	}()
+	return p, conn.LocalAddr().String()
+}
+
+func testClient(t *testing.T, server string, tunnelIP string, cipher *packetCipher) (*PlainVPN, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &PlainVPN{config: &config.Config{ClientID: "laptop", ClientTunIP: tunnelIP}, mtu: 1500, cipher: cipher}, conn
+}
+
+func TestHandshake(t *testing.T) {
+	serverCipher, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCipher, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, address := testServer(t, serverCipher)
+	client, conn := testClient(t, address, "10.108.0.7/24", clientCipher)
+
+	accepted, err := client.handshake(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.108.0.7/24"}
+	if !reflect.DeepEqual(accepted.TunnelIPs, want) || accepted.MTU != 1400 || accepted.KeepaliveInterval != 10 {
+		t.Errorf("welcomed with %+v", accepted)
+	}
+	if !reflect.DeepEqual(accepted.ServerTunnelIPs, []string{"10.108.0.1/24"}) {
+		t.Errorf("server tunnel IPs %v", accepted.ServerTunnelIPs)
+	}
+	if session, ok := server.sessions.Lookup("10.108.0.7"); !ok || session.ClientID != "laptop" {
+		t.Error("no session opened for the client")
+	}
+	if client.serverReplay == nil || client.serverReplay.sender != serverCipher.senderID {
+		t.Error("client not bound to the server's sender id")
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	tests := []struct {
+		tunnelIP string
+		reason   string
+	}{
+		{"10.109.0.7/24", "outside the server's tunnel subnets"},
+		{"10.108.0.1/24", "is the server's"},
+		{"10.108.0.255/24", "not a host address"},
+		{"0.0.0.0/0", "outside the server's tunnel subnets"},
+	}
+	_, address := testServer(t, nil)
+	for _, test := range tests {
+		client, conn := testClient(t, address, test.tunnelIP, nil)
+		_, err := client.handshake(context.Background(), conn)
+		if !errors.Is(err, errRejected) || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: got %v, want a rejection saying %q", test.tunnelIP, err, test.reason)
+		}
+	}
+}
+
+func TestHandshakeIgnoresOtherNonce(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		datagram := make([]byte, 65535)
+		n, clientAddr, err := conn.ReadFromUDP(datagram)
+		if err != nil {
+			return
+		}
+		_, payload, _ := decodeFrame(datagram[:n])
+		var request hello
+		if decodeControl(messageHello, payload, &request) != nil {
+			return
+		}
+		// A welcome meant for an earlier handshake arrives first
+		for _, answer := range []welcome{
+			{Nonce: "stale", TunnelIPs: []string{"10.108.0.99/24"}},
+			{Nonce: request.Nonce, TunnelIPs: []string{"10.108.0.7/24"}},
+		} {
+			frame, _ := encodeControl(messageWelcome, answer)
+			conn.WriteToUDP(frame, clientAddr)
+		}
+	}()
+
+	client, clientConn := testClient(t, conn.LocalAddr().String(), "10.108.0.7/24", nil)
+	accepted, err := client.handshake(context.Background(), clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accepted.TunnelIPs, []string{"10.108.0.7/24"}) {
+		t.Errorf("took the welcome of another handshake: %+v", accepted)
+	}
+}
+
+func TestFreshHello(t *testing.T) {
+	p := &PlainVPN{lastHello: cmap.New[int64]()}
+	now := time.Now()
+	tests := []struct {
+		name string
+		sent time.Time
+		want bool
+	}{
+		{"first hello", now, true},
+		{"replayed hello", now, false},
+		{"older hello", now.Add(-time.Second), false},
+		{"newer hello", now.Add(time.Second), true},
+		{"stale hello", now.Add(-helloFreshness - time.Minute), false},
+		{"hello from the future", now.Add(helloFreshness + time.Minute), false},
+	}
+	for _, test := range tests {
+		if got := p.freshHello(hello{ClientID: "laptop", Timestamp: test.sent.UnixNano()}); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
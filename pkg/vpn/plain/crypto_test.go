@@ -0,0 +1,147 @@
+package plain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPSK = bytes.Repeat([]byte{0x42}, 32)
+
+func TestSealOpen(t *testing.T) {
+	client, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.senderID == server.senderID {
+		t.Fatal("both ends picked the same sender id")
+	}
+
+	frames := [][]byte{[]byte("first"), {}, []byte("third")}
+	for i, frame := range frames {
+		sender, counter, opened, err := server.Open(client.Seal(frame))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if sender != client.senderID || counter != uint64(i+1) || !bytes.Equal(opened, frame) {
+			t.Errorf("frame %d: got sender %x, counter %d, %q", i, sender, counter, opened)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	client, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := newPacketCipher(bytes.Repeat([]byte{0x24}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := client.Seal([]byte("frame"))
+	tamper := func(i int) []byte {
+		datagram := append([]byte(nil), sealed...)
+		datagram[i] ^= 1
+		return datagram
+	}
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     error
+	}{
+		{"empty", nil, errShortDatagram},
+		{"header only", sealed[:sealedHeadLen], errShortDatagram},
+		{"truncated tag", sealed[:len(sealed)-1], errAuthentication},
+		{"sender id changed", tamper(0), errAuthentication},
+		{"counter changed", tamper(senderIDLen), errAuthentication},
+		{"ciphertext changed", tamper(sealedHeadLen), errAuthentication},
+		{"tag changed", tamper(len(sealed) - 1), errAuthentication},
+		{"other key", otherKey.Seal([]byte("frame")), errAuthentication},
+	}
+	for _, test := range tests {
+		if _, _, _, err := client.Open(test.datagram); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	window := newReplayWindow(senderID{1})
+	tests := []struct {
+		counter uint64
+		want    bool
+	}{
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{3, false},
+		{10000, true},
+		{9000, true},
+		{9000, false},
+		{2, false},
+		{counterLimit, false},
+	}
+	for _, test := range tests {
+		if got := window.Accept(test.counter); got != test.want {
+			t.Errorf("counter %d: got %t, want %t", test.counter, got, test.want)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	c, err := newPacketCipher(testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PlainVPN{cipher: c}
+	window := newReplayWindow(senderID{1})
+	if !p.accept(window, senderID{1}, 1) {
+		t.Error("first message rejected")
+	}
+	if p.accept(window, senderID{1}, 1) || p.stats.Replays.Load() != 1 {
+		t.Errorf("replay accepted or not counted, %d replays", p.stats.Replays.Load())
+	}
+	if p.accept(window, senderID{2}, 2) || p.accept(nil, senderID{1}, 2) || p.stats.AuthFailures.Load() != 2 {
+		t.Errorf("message from the wrong sender accepted or not counted, %d failures", p.stats.AuthFailures.Load())
+	}
+	if !(&PlainVPN{}).accept(nil, senderID{}, 0) {
+		t.Error("message rejected without a pre-shared key")
+	}
+}
+
+func TestLoadPreSharedKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid key with newline", base64.StdEncoding.EncodeToString(testPSK) + "\n", false},
+		{"not base64", "not a key", true},
+		{"short key", base64.StdEncoding.EncodeToString(testPSK[:16]), true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := loadPreSharedKey(path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if err == nil && !bytes.Equal(key, testPSK) {
+			t.Errorf("%s: got key %x", test.name, key)
+		}
+	}
+	if _, err := loadPreSharedKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing key file loaded")
+	}
+}
@@ -0,0 +1,81 @@
+package plain
+
+import (
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"log"
+	"net"
+	"reflect"
+)
+
+// Reload applies a changed configuration without touching the TUN device or the sessions of
+// clients that are still welcome. Settings that need a restart are logged and left alone.
+func (p *PlainVPN) Reload(cfg *config.Config) error {
+	for _, setting := range p.config.RestartRequired(cfg) {
+		log.Printf("Changed %s only takes effect after a restart", setting)
+	}
+	if p.config.ServerMode {
+		return p.reloadServer(cfg)
+	}
+	return p.reloadClient(cfg)
+}
+
+// reloadServer updates the peers and allowed clients, saying goodbye to clients that are no
+// longer allowed. Changed DNS settings and keepalive interval apply to the next welcome.
+func (p *PlainVPN) reloadServer(cfg *config.Config) error {
+	p.configMu.Lock()
+	previousPeers := p.config.Peers
+	p.config.Reload(cfg)
+	p.configMu.Unlock()
+
+	if p.pool != nil {
+		current := map[string]config.Peer{}
+		for _, peer := range cfg.Peers {
+			current[peer.ID] = peer
+		}
+		for _, peer := range previousPeers {
+			if next, ok := current[peer.ID]; !ok || !reflect.DeepEqual(peer.TunnelIPs, next.TunnelIPs) {
+				if err := p.pool.Release(peer.ID); err != nil {
+					return err
+				}
+				log.Printf("Released the addresses of peer %s", peer.ID)
+			}
+		}
+		if err := p.reservePeers(cfg.Peers); err != nil {
+			return err
+		}
+	}
+
+	if p.sessions == nil {
+		return nil
+	}
+	bye, err := encodeControl(messageBye, nil)
+	if err != nil {
+		return err
+	}
+	serverConn, _ := p.currentConn().(*net.UDPConn)
+	for _, session := range p.sessions.Sessions() {
+		if p.clientAllowed(session.ClientID) {
+			continue
+		}
+		log.Printf("Disconnecting %s, which is no longer allowed", session.ClientID)
+		if serverConn != nil {
+			serverConn.WriteToUDP(p.seal(bye), session.Endpoint())
+		}
+		p.sessions.Remove(session)
+		p.retireClient(session)
+	}
+	return nil
+}
+
+// reloadClient brings the routes through the tunnel in line with the new configuration
+func (p *PlainVPN) reloadClient(cfg *config.Config) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	next, err := netconf.ClientRoutes(cfg, p.tunnelIPs)
+	if err != nil {
+		return err
+	}
+	p.config.Reload(cfg)
+	return p.routes.Set(next)
+}
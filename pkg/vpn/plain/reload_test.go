@@ -0,0 +1,107 @@
+package plain
+
+import (
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/ipam"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReloadServerPeers(t *testing.T) {
+	pool, err := ipam.NewPool([]string{"10.108.0.0/24"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []config.Peer{
+		{ID: "desktop", TunnelIPs: []string{"10.108.0.2"}},
+		{ID: "laptop", TunnelIPs: []string{"10.108.0.3"}},
+		{ID: "printer", TunnelIPs: []string{"10.108.0.4"}},
+	}
+	// The tunnel interface does not exist, so no client routes are touched
+	p := &PlainVPN{config: &config.Config{ServerMode: true, TunName: "safehaven-test", Peers: peers}, pool: pool, sessions: NewSessionTable(time.Minute)}
+	if err := p.reservePeers(peers); err != nil {
+		t.Fatal(err)
+	}
+
+	next := &config.Config{ServerMode: true, Peers: []config.Peer{
+		{ID: "desktop", TunnelIPs: []string{"10.108.0.2"}},
+		{ID: "laptop", TunnelIPs: []string{"10.108.0.13"}},
+		{ID: "phone", TunnelIPs: []string{"10.108.0.5"}},
+	}}
+	if err := p.reloadServer(next); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.config.Peers, next.Peers) {
+		t.Errorf("peers %v, want %v", p.config.Peers, next.Peers)
+	}
+	leased := map[string]string{}
+	for _, lease := range pool.Leases() {
+		leased[lease.ClientID] = lease.Address.String()
+	}
+	want := map[string]string{"desktop": "10.108.0.2", "laptop": "10.108.0.13", "phone": "10.108.0.5"}
+	if !reflect.DeepEqual(leased, want) {
+		t.Errorf("leases %v, want %v", leased, want)
+	}
+}
+
+func TestReloadServerDisconnectsClients(t *testing.T) {
+	p := &PlainVPN{config: &config.Config{ServerMode: true, AllowedClients: []string{"laptop", "phone"}}, sessions: NewSessionTable(time.Minute)}
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	p.setConn(serverConn)
+	phoneConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer phoneConn.Close()
+	laptop := p.sessions.Open("laptop", []string{"10.108.0.7"}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, nil)
+	phone := p.sessions.Open("phone", []string{"10.108.0.8"}, phoneConn.LocalAddr().(*net.UDPAddr), nil)
+
+	next := &config.Config{ServerMode: true, AllowedClients: []string{"laptop"}, DNSServers: []string{"10.108.0.53"}}
+	if err := p.reloadServer(next); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := p.sessions.Lookup("10.108.0.7"); !ok || found != laptop {
+		t.Error("disconnected a client that is still allowed")
+	}
+	if _, ok := p.sessions.Lookup("10.108.0.8"); ok {
+		t.Error("kept the session of a client that is no longer allowed")
+	}
+	if !reflect.DeepEqual(p.config.DNSServers, next.DNSServers) {
+		t.Errorf("DNS servers %v, want the new ones for the next welcome", p.config.DNSServers)
+	}
+
+	phoneConn.SetReadDeadline(time.Now().Add(time.Second))
+	datagram := make([]byte, 64)
+	n, _, err := phoneConn.ReadFromUDP(datagram)
+	if err != nil {
+		t.Fatalf("%s was not told: %v", phone.ClientID, err)
+	}
+	if messageType, _, err := decodeFrame(datagram[:n]); err != nil || messageType != messageBye {
+		t.Errorf("%s got a %s message, %v", phone.ClientID, messageType, err)
+	}
+}
+
+func TestReloadServerKeepsOtherLeases(t *testing.T) {
+	pool, err := ipam.NewPool([]string{"10.108.0.0/24"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PlainVPN{config: &config.Config{ServerMode: true}, pool: pool, sessions: NewSessionTable(time.Minute)}
+	if err := pool.Reserve("laptop", netip.MustParseAddr("10.108.0.9")); err != nil {
+		t.Fatal(err)
+	}
+	// A client that is not a peer keeps its lease when the peers change
+	if err := p.reloadServer(&config.Config{ServerMode: true, Peers: []config.Peer{{ID: "desktop", TunnelIPs: []string{"10.108.0.2"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if leases := pool.Lookup("laptop"); len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.9") {
+		t.Errorf("laptop leases %v", leases)
+	}
+}
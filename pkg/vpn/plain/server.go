@@ -0,0 +1,552 @@
+package plain
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/firewall"
+	"github.com/kwakubiney/safehaven/pkg/ipam"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"github.com/kwakubiney/safehaven/pkg/packet"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+func (p *PlainVPN) startServer(ctx context.Context) error {
+	log.Println("Setting up TUN interface...")
+	err := p.setTunOnDevice()
+	if err != nil {
+		return err
+	}
+	log.Printf("TUN interface %s created successfully", p.config.TunName)
+
+	p.sessions = NewSessionTable(p.config.SessionTimeout)
+	p.tunnelIPs = utils.SplitAddressList(p.config.ServerTunIP)
+	p.mtu, err = netconf.TunnelMTU(p.config, p.overhead())
+	if err != nil {
+		return err
+	}
+
+	if p.config.ClientPool != "" {
+		var serverTunIPs []netip.Addr
+		for _, tunnelIP := range p.tunnelIPs {
+			serverTunIP, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+			if err != nil {
+				return fmt.Errorf("invalid server tun IP %s: %w", tunnelIP, err)
+			}
+			serverTunIPs = append(serverTunIPs, serverTunIP)
+		}
+		p.pool, err = ipam.NewPool(utils.SplitAddressList(p.config.ClientPool), p.config.LeaseFile, p.config.LeaseTime, serverTunIPs...)
+		if err != nil {
+			return fmt.Errorf("failed to set up client address pool: %w", err)
+		}
+		if err := p.reservePeers(p.config.Peers); err != nil {
+			return err
+		}
+		log.Printf("Client address pool %v ready with %d existing leases", p.pool.Prefixes(), len(p.pool.Leases()))
+	}
+
+	log.Println("Configuring TUN IP address...")
+	err = p.assignIPToTun()
+	if err != nil {
+		return err
+	}
+	log.Printf("TUN interface IP configured: %s", p.config.ServerTunIP)
+
+	log.Println("Setting up network routes...")
+	err = p.createRoutes()
+	if err != nil {
+		return err
+	}
+	if p.pool == nil {
+		log.Printf("Route to client (%s) configured", p.config.ClientTunIP)
+	}
+
+	if p.config.NATInterface != "" {
+		subnets, err := firewall.TunnelSubnets(p.config)
+		if err != nil {
+			return err
+		}
+		if err := firewall.EnableNAT(&p.undo, p.config.NATInterface, subnets); err != nil {
+			return err
+		}
+	}
+
+	localAddress, _ := strconv.Atoi(p.config.LocalAddress)
+	log.Printf("Starting UDP server on port %d...", localAddress)
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localAddress})
+	if err != nil {
+		return err
+	}
+	p.setConn(serverConn)
+	log.Printf("UDP server listening on port %d", localAddress)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		log.Println("Started client receive handler")
+		for {
+			select {
+			case <-ctx.Done():
+				fmt.Println("Exiting loop...")
+				return
+			default:
+				datagram := make([]byte, 65535)
+				n, clientAddr, err := serverConn.ReadFromUDP(datagram)
+				if err != nil {
+					log.Printf("Error receiving from client: %v", err)
+					continue
+				}
+				sender, counter, frame, err := p.open(datagram[:n])
+				if err != nil {
+					continue
+				}
+				t, payload, err := decodeFrame(frame)
+				if err != nil {
+					log.Printf("Dropping frame from %s: %v", clientAddr, err)
+					continue
+				}
+
+				switch t {
+				case messageData:
+					parsed, err := packet.Parse(payload)
+					if err != nil {
+						p.stats.Malformed.Add(1)
+						log.Printf("Dropping malformed packet from %s: %v", clientAddr, err)
+						continue
+					}
+					session, ok := p.sessions.Lookup(parsed.Src.String())
+					if !ok {
+						log.Printf("Dropping packet %s from %s: no session", parsed, clientAddr)
+						continue
+					}
+					if !p.accept(session.replay, sender, counter) {
+						continue
+					}
+					p.sessions.Touch(session, clientAddr)
+
+					_, err = p.tunDevice.Write(payload)
+					if err != nil {
+						log.Printf("Error writing to TUN: %v", err)
+						continue
+					}
+				case messageHello:
+					p.handleHello(serverConn, clientAddr, sender, counter, payload)
+				case messageKeepalive:
+					var alive keepalive
+					if err := decodeControl(t, payload, &alive); err != nil {
+						log.Printf("Dropping keepalive from %s: %v", clientAddr, err)
+						continue
+					}
+					session, ok := p.sessions.Lookup(alive.TunnelIP)
+					if !ok {
+						p.sendControl(serverConn, clientAddr, messageReject, reject{Reason: "no session"})
+						continue
+					}
+					if !p.accept(session.replay, sender, counter) {
+						continue
+					}
+					p.sessions.Touch(session, clientAddr)
+					p.sendControl(serverConn, clientAddr, messageKeepalive, nil)
+				case messageBye:
+					session, ok := p.sessions.LookupEndpoint(clientAddr)
+					if !ok || !p.accept(session.replay, sender, counter) {
+						continue
+					}
+					log.Printf("Client %s at %s said goodbye", session.ClientID, clientAddr)
+					p.sessions.Remove(session)
+					p.retireClient(session)
+				default:
+					log.Printf("Ignoring unexpected %s message from %s", t, clientAddr)
+				}
+			}
+		}
+	}()
+
+	log.Println("Started client send handler")
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				fmt.Println("Exiting loop...")
+				return
+			default:
+				frame := make([]byte, frameHeaderLen+p.mtu)
+				n, err := p.tunDevice.Read(frame[frameHeaderLen:])
+				if err != nil {
+					log.Printf("Error reading from TUN: %v", err)
+					break
+				}
+
+				parsed, err := packet.Parse(frame[frameHeaderLen : frameHeaderLen+n])
+				if err != nil {
+					p.stats.Malformed.Add(1)
+					log.Printf("Dropping malformed packet from TUN: %v", err)
+					continue
+				}
+				session, ok := p.sessions.Lookup(parsed.Dst.String())
+				if ok {
+					destinationUDPAddress := session.Endpoint()
+					putFrameHeader(frame, messageData)
+					_, err = serverConn.WriteToUDP(p.seal(frame[:frameHeaderLen+n]), destinationUDPAddress)
+					if err != nil {
+						log.Printf("Error sending to client %s: %v", destinationUDPAddress.String(), err)
+						continue
+					}
+				}
+			}
+		}
+	}()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.expireSessions(ctx)
+	}()
+	if p.pool != nil && p.config.LeaseTime > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.expireLeases(ctx)
+		}()
+	}
+
+	// Wait for context cancellation
+	<-ctx.Done()
+	log.Println("VPN server shutting down...")
+	return nil
+}
+
+// handleHello admits a client announcing itself, giving it a tunnel address and a session
+func (p *PlainVPN) handleHello(conn *net.UDPConn, clientAddr *net.UDPAddr, sender senderID, counter uint64, payload []byte) {
+	var request hello
+	if err := decodeControl(messageHello, payload, &request); err != nil {
+		log.Printf("Dropping hello from %s: %v", clientAddr, err)
+		return
+	}
+	if p.cipher != nil && !p.freshHello(request) {
+		log.Printf("Dropping stale or replayed hello from %s at %s", request.ClientID, clientAddr)
+		p.stats.Replays.Add(1)
+		return
+	}
+	if request.ClientID == "" {
+		p.sendControl(conn, clientAddr, messageReject, reject{Reason: "missing client id"})
+		return
+	}
+	if !p.clientAllowed(request.ClientID) {
+		log.Printf("Rejecting unknown client %s at %s", request.ClientID, clientAddr)
+		p.sendControl(conn, clientAddr, messageReject, reject{Reason: "client not allowed"})
+		return
+	}
+
+	tunnelIPs, err := p.leaseTunnelIPs(request.ClientID, request.TunnelIPs)
+	if err != nil {
+		log.Printf("Rejecting client %s at %s: %v", request.ClientID, clientAddr, err)
+		p.sendControl(conn, clientAddr, messageReject, reject{Reason: err.Error()})
+		return
+	}
+
+	mtu := p.mtu
+	if request.MTU > 0 && request.MTU < mtu {
+		mtu = request.MTU
+	}
+	replay := newReplayWindow(sender)
+	replay.Accept(counter)
+	p.sessions.Open(request.ClientID, tunnelIPs, clientAddr, replay)
+	p.configMu.RLock()
+	accepted := welcome{
+		Nonce:             request.Nonce,
+		TunnelIPs:         tunnelIPs,
+		ServerTunnelIPs:   p.tunnelIPs,
+		MTU:               mtu,
+		KeepaliveInterval: int(p.config.KeepaliveInterval / time.Second),
+		DNS:               p.config.DNSServers,
+		SearchDomains:     p.config.SearchDomains,
+	}
+	p.configMu.RUnlock()
+	p.sendControl(conn, clientAddr, messageWelcome, accepted)
+}
+
+// freshHello rejects hellos that are too old or not newer than the last one from the same client,
+// which is what keeps a recorded hello from being replayed to hijack a session
+func (p *PlainVPN) freshHello(request hello) bool {
+	sent := time.Unix(0, request.Timestamp)
+	if age := time.Since(sent); age > helloFreshness || age < -helloFreshness {
+		return false
+	}
+	fresh := false
+	p.lastHello.Upsert(request.ClientID, request.Timestamp, func(exists bool, current int64, timestamp int64) int64 {
+		if exists && current >= timestamp {
+			return current
+		}
+		fresh = true
+		return timestamp
+	})
+	return fresh
+}
+
+func (p *PlainVPN) clientAllowed(clientID string) bool {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	if len(p.config.AllowedClients) == 0 {
+		return true
+	}
+	for _, allowed := range p.config.AllowedClients {
+		if allowed == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseTunnelIPs picks the tunnel addresses for a client, in CIDR notation. With a pool the
+// requested addresses are honoured when they are free, otherwise the client's leases are used.
+// Without one the client's own addresses are taken, as long as they fit the server's subnets.
+func (p *PlainVPN) leaseTunnelIPs(clientID string, requested []string) ([]string, error) {
+	if p.pool == nil {
+		if len(requested) == 0 {
+			return nil, fmt.Errorf("no tunnel address requested")
+		}
+		for _, tunnelIP := range requested {
+			if err := p.checkTunnelIP(tunnelIP); err != nil {
+				return nil, err
+			}
+			if session, ok := p.sessions.Lookup(tunnelIP); ok && session.ClientID != clientID {
+				return nil, fmt.Errorf("tunnel address %s is in use", tunnelIP)
+			}
+		}
+		return requested, nil
+	}
+
+	if p.isPeer(clientID) {
+		// Peers always get the addresses reserved for them
+		requested = nil
+	}
+	for _, tunnelIP := range requested {
+		addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+		if err == nil && p.pool.Contains(addr) {
+			if err := p.pool.Reserve(clientID, addr); err != nil {
+				log.Printf("Not giving %s its requested address: %v", clientID, err)
+			}
+		}
+	}
+	addrs, err := p.pool.Allocate(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnelIPs []string
+	for _, addr := range addrs {
+		if err := p.addClientRoute(addr); err != nil {
+			return nil, err
+		}
+		prefix, _ := p.pool.PrefixFor(addr)
+		tunnelIPs = append(tunnelIPs, prefix.String())
+	}
+	return tunnelIPs, nil
+}
+
+// checkTunnelIP makes sure an address a client picked for itself lies in one of the server's
+// tunnel subnets, and is neither the server's own address nor the subnet's network or broadcast
+// address
+func (p *PlainVPN) checkTunnelIP(tunnelIP string) error {
+	addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid tunnel address %s", tunnelIP)
+	}
+	addr = addr.Unmap()
+	p.configMu.RLock()
+	serverIPs := p.tunnelIPs
+	p.configMu.RUnlock()
+	for _, serverIP := range serverIPs {
+		server, err := netip.ParsePrefix(serverIP)
+		if err != nil || !server.Contains(addr) {
+			continue
+		}
+		if addr == server.Addr() {
+			return fmt.Errorf("tunnel address %s is the server's", addr)
+		}
+		if subnet := server.Masked(); addr.Is4() && subnet.Bits() < 31 && (addr == subnet.Addr() || addr == broadcast(subnet)) {
+			return fmt.Errorf("tunnel address %s is not a host address of %s", addr, subnet)
+		}
+		return nil
+	}
+	return fmt.Errorf("tunnel address %s is outside the server's tunnel subnets", addr)
+}
+
+// broadcast returns the last address of an IPv4 subnet
+func broadcast(subnet netip.Prefix) netip.Addr {
+	addr := subnet.Addr().As4()
+	last := binary.BigEndian.Uint32(addr[:]) | (1<<(32-subnet.Bits()) - 1)
+	binary.BigEndian.PutUint32(addr[:], last)
+	return netip.AddrFrom4(addr)
+}
+
+// reservePeers leases every peer the tunnel addresses configured for it
+func (p *PlainVPN) reservePeers(peers []config.Peer) error {
+	for _, peer := range peers {
+		for _, tunnelIP := range peer.TunnelIPs {
+			addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+			if err != nil {
+				return fmt.Errorf("invalid tunnel IP %s for peer %s: %w", tunnelIP, peer.ID, err)
+			}
+			if err := p.pool.Reserve(peer.ID, addr); err != nil {
+				return fmt.Errorf("failed to reserve %s for peer %s: %w", addr, peer.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PlainVPN) isPeer(clientID string) bool {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	for _, peer := range p.config.Peers {
+		if peer.ID == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// retireClient withdraws the routes of a client whose session ended. The leases themselves are
+// kept so the client gets the same addresses when it comes back.
+func (p *PlainVPN) retireClient(session *Session) {
+	if p.pool == nil {
+		return
+	}
+	for _, tunnelIP := range session.TunnelIPs {
+		addr, err := netip.ParseAddr(tunnelIP)
+		if err != nil {
+			continue
+		}
+		if err := p.removeClientRoute(addr); err != nil {
+			log.Printf("Failed to remove route for client %s: %v", session.ClientID, err)
+		}
+	}
+}
+
+// expireSessions periodically drops clients that have gone quiet for longer than the session timeout
+func (p *PlainVPN) expireSessions(ctx context.Context) {
+	if p.config.SessionTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.config.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, session := range p.sessions.Expire() {
+				log.Printf("Session for %s at %s expired after %s idle",
+					session.ClientID, session.Endpoint(), p.config.SessionTimeout)
+				p.retireClient(session)
+			}
+			// Hellos this old are refused anyway, so there is nothing left to compare against
+			p.lastHello.IterCb(func(clientID string, timestamp int64) {
+				if time.Since(time.Unix(0, timestamp)) > helloFreshness {
+					p.lastHello.RemoveCb(clientID, func(_ string, current int64, exists bool) bool {
+						return exists && current == timestamp
+					})
+				}
+			})
+		}
+	}
+}
+
+// expireLeases periodically reclaims the addresses of clients gone for longer than the lease
+// time. Connected clients and peers keep theirs.
+func (p *PlainVPN) expireLeases(ctx context.Context) {
+	interval := p.config.LeaseTime / 2
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := p.expireLeasesOnce()
+			if err != nil {
+				log.Printf("Failed to save leases: %v", err)
+			}
+			for _, lease := range expired {
+				log.Printf("Lease of %s for %s expired", lease.Address, lease.ClientID)
+			}
+		}
+	}
+}
+
+// expireLeasesOnce reclaims the expired leases of clients that are neither connected nor
+// peers. The clients to keep are collected up front, as the pool runs its callback with its
+// lock held and AddPeer takes configMu before the pool lock.
+func (p *PlainVPN) expireLeasesOnce() ([]ipam.Lease, error) {
+	keep := map[string]bool{}
+	for _, session := range p.sessions.Sessions() {
+		keep[session.ClientID] = true
+	}
+	p.configMu.RLock()
+	for _, peer := range p.config.Peers {
+		keep[peer.ID] = true
+	}
+	p.configMu.RUnlock()
+	return p.pool.Expire(func(clientID string) bool {
+		return keep[clientID]
+	})
+}
+
+func (p *PlainVPN) sendControl(conn *net.UDPConn, clientAddr *net.UDPAddr, t messageType, message interface{}) {
+	frame, err := encodeControl(t, message)
+	if err != nil {
+		log.Printf("Error encoding %s for %s: %v", t, clientAddr, err)
+		return
+	}
+	if _, err := conn.WriteToUDP(p.seal(frame), clientAddr); err != nil {
+		log.Printf("Error sending %s to %s: %v", t, clientAddr, err)
+	}
+}
+
+func (p *PlainVPN) clientRoute(addr netip.Addr) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(p.config.TunName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TUN interface %s: %w", p.config.TunName, err)
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       utils.HostPrefix(addr.AsSlice()),
+	}, nil
+}
+
+func (p *PlainVPN) addClientRoute(addr netip.Addr) error {
+	route, err := p.clientRoute(addr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add route for client %s: %w", addr, err)
+	}
+	log.Printf("Added route for client %s", addr)
+	return nil
+}
+
+func (p *PlainVPN) removeClientRoute(addr netip.Addr) error {
+	route, err := p.clientRoute(addr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("failed to remove route for client %s: %w", addr, err)
+	}
+	log.Printf("Removed route for client %s", addr)
+	return nil
+}
@@ -0,0 +1,109 @@
+package plain
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/ipam"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpireLeasesWhileAddingPeers(t *testing.T) {
+	pool, err := ipam.NewPool([]string{"10.108.0.0/24"}, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PlainVPN{config: &config.Config{ServerMode: true}, pool: pool, sessions: NewSessionTable(time.Minute)}
+
+	added := make(chan error, 1)
+	go func() {
+		// Peers are added again and again to give the two a chance to interleave
+		for i := 0; i < 5000; i++ {
+			host := 2 + i%98
+			peer := config.Peer{ID: fmt.Sprintf("peer%d", host), TunnelIPs: []string{fmt.Sprintf("10.108.0.%d", host)}}
+			if err := p.AddPeer(peer); err != nil {
+				added <- err
+				return
+			}
+		}
+		added <- nil
+	}()
+	stop := make(chan struct{})
+	expired := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				expired <- nil
+				return
+			default:
+			}
+			if _, err := p.expireLeasesOnce(); err != nil {
+				expired <- err
+				return
+			}
+		}
+	}()
+
+	timeout := time.After(10 * time.Second)
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("adding peers while expiring leases deadlocked")
+	}
+	close(stop)
+	select {
+	case err := <-expired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("expiring leases while adding peers deadlocked")
+	}
+	if leases := pool.Leases(); len(leases) != 98 {
+		t.Errorf("%d leases left, want one per peer", len(leases))
+	}
+}
+
+func TestAddPeerKeepsLeasesWhenReserveFails(t *testing.T) {
+	pool, err := ipam.NewPool([]string{"10.108.0.0/24"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := config.Peer{ID: "laptop", TunnelIPs: []string{"10.108.0.5/24"}}
+	p := &PlainVPN{config: &config.Config{ServerMode: true, Peers: []config.Peer{peer}}, pool: pool}
+	if err := p.reservePeers(p.config.Peers); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("phone", netip.MustParseAddr("10.108.0.10")); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := config.Peer{ID: "laptop", TunnelIPs: []string{"10.108.0.10/24"}}
+	if err := p.AddPeer(moved); err == nil {
+		t.Fatal("peer took an address leased to another client")
+	}
+	if leases := pool.Lookup("laptop"); len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.5") {
+		t.Errorf("peer holds %v after the failed update, want 10.108.0.5", leases)
+	}
+	if !reflect.DeepEqual(p.config.Peers, []config.Peer{peer}) {
+		t.Errorf("peers changed to %v", p.config.Peers)
+	}
+
+	// Adding a peer under a known id replaces it rather than adding another
+	moved.TunnelIPs = []string{"10.108.0.6"}
+	if err := p.AddPeer(moved); err != nil {
+		t.Fatal(err)
+	}
+	if leases := pool.Lookup("laptop"); len(leases) != 1 || leases[0].Address != netip.MustParseAddr("10.108.0.6") {
+		t.Errorf("peer holds %v, want 10.108.0.6", leases)
+	}
+	if !reflect.DeepEqual(p.config.Peers, []config.Peer{moved}) {
+		t.Errorf("peers are %v, want only the updated one", p.config.Peers)
+	}
+}
@@ -0,0 +1,199 @@
+package plain
+
+import (
+	"github.com/kwakubiney/safehaven/utils"
+	cmap "github.com/orcaman/concurrent-map/v2"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session tracks a single client reachable through the server, keyed by its tunnel IPs.
+type Session struct {
+	ClientID  string
+	TunnelIPs []string
+
+	replay   *replayWindow
+	mu       sync.RWMutex
+	endpoint *net.UDPAddr
+	lastSeen time.Time
+}
+
+// Endpoint returns the UDP address the client was last seen at
+func (s *Session) Endpoint() *net.UDPAddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.endpoint
+}
+
+// LastSeen returns the time the client last sent us a packet
+func (s *Session) LastSeen() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSeen
+}
+
+// touch refreshes the session and returns the previous endpoint if the client roamed
+func (s *Session) touch(endpoint *net.UDPAddr, now time.Time) (*net.UDPAddr, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	if sameEndpoint(s.endpoint, endpoint) {
+		return nil, false
+	}
+	previous := s.endpoint
+	s.endpoint = endpoint
+	return previous, true
+}
+
+// SessionTable maps client tunnel IPs to the UDP endpoints they talk to us from.
+// A dual-stack client has one entry per address family pointing at the same session.
+type SessionTable struct {
+	mu         sync.Mutex
+	sessions   cmap.ConcurrentMap[string, *Session]
+	byEndpoint cmap.ConcurrentMap[string, *Session]
+	timeout    time.Duration
+}
+
+func NewSessionTable(timeout time.Duration) *SessionTable {
+	return &SessionTable{
+		sessions:   cmap.New[*Session](),
+		byEndpoint: cmap.New[*Session](),
+		timeout:    timeout,
+	}
+}
+
+// Open starts a session for clientID at tunnelIPs, replacing any previous session holding those addresses.
+// The replay window binds the session to the sender that completed the handshake.
+func (t *SessionTable) Open(clientID string, tunnelIPs []string, endpoint *net.UDPAddr, replay *replayWindow) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session := &Session{ClientID: clientID, replay: replay}
+	for _, tunnelIP := range tunnelIPs {
+		session.TunnelIPs = append(session.TunnelIPs, canonicalIP(tunnelIP))
+	}
+	for _, tunnelIP := range session.TunnelIPs {
+		if previous, ok := t.sessions.Get(tunnelIP); ok {
+			t.remove(previous)
+		}
+	}
+	session.touch(endpoint, time.Now())
+	for _, tunnelIP := range session.TunnelIPs {
+		t.sessions.Set(tunnelIP, session)
+	}
+	t.byEndpoint.Set(endpoint.String(), session)
+	log.Printf("New session for %s (%s) at %s", clientID, strings.Join(session.TunnelIPs, ", "), endpoint)
+	return session
+}
+
+// Touch records traffic from the session's client at endpoint, following the client if it roamed
+func (t *SessionTable) Touch(session *Session, endpoint *net.UDPAddr) {
+	previous, roamed := session.touch(endpoint, time.Now())
+	if !roamed {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if previous != nil {
+		t.byEndpoint.RemoveCb(previous.String(), func(_ string, current *Session, exists bool) bool {
+			return exists && current == session
+		})
+	}
+	t.byEndpoint.Set(endpoint.String(), session)
+	log.Printf("Session for %s roamed from %s to %s", session.ClientID, previous, endpoint)
+}
+
+// Lookup returns the live session for tunnelIP, if any
+func (t *SessionTable) Lookup(tunnelIP string) (*Session, bool) {
+	session, ok := t.sessions.Get(canonicalIP(tunnelIP))
+	if !ok || t.expired(session, time.Now()) {
+		return nil, false
+	}
+	return session, true
+}
+
+// LookupEndpoint returns the live session last seen at endpoint, if any
+func (t *SessionTable) LookupEndpoint(endpoint *net.UDPAddr) (*Session, bool) {
+	session, ok := t.byEndpoint.Get(endpoint.String())
+	if !ok || t.expired(session, time.Now()) {
+		return nil, false
+	}
+	return session, true
+}
+
+// Remove drops session from the table
+func (t *SessionTable) Remove(session *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(session)
+}
+
+// Sessions returns a snapshot of all sessions in the table
+func (t *SessionTable) Sessions() []*Session {
+	seen := map[*Session]bool{}
+	sessions := make([]*Session, 0, t.sessions.Count())
+	for _, session := range t.sessions.Items() {
+		if !seen[session] {
+			seen[session] = true
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// Expire removes every session idle for longer than the table timeout and returns them
+func (t *SessionTable) Expire() []*Session {
+	now := time.Now()
+	var expired []*Session
+	for _, session := range t.Sessions() {
+		if t.expired(session, now) {
+			t.Remove(session)
+			expired = append(expired, session)
+		}
+	}
+	return expired
+}
+
+func (t *SessionTable) remove(session *Session) {
+	for _, tunnelIP := range session.TunnelIPs {
+		t.sessions.RemoveCb(tunnelIP, func(_ string, current *Session, exists bool) bool {
+			return exists && current == session
+		})
+	}
+	t.unindex(session)
+}
+
+func (t *SessionTable) unindex(session *Session) {
+	endpoint := session.Endpoint()
+	if endpoint == nil {
+		return
+	}
+	t.byEndpoint.RemoveCb(endpoint.String(), func(_ string, current *Session, exists bool) bool {
+		return exists && current == session
+	})
+}
+
+func (t *SessionTable) expired(session *Session, now time.Time) bool {
+	return t.timeout > 0 && now.Sub(session.LastSeen()) > t.timeout
+}
+
+// canonicalIP normalises the textual form of an address so IPv6 keys match however they were written
+func canonicalIP(ip string) string {
+	addr, err := netip.ParseAddr(utils.RemoveCIDRSuffix(ip, "/"))
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().String()
+}
+
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
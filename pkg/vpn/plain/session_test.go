@@ -0,0 +1,116 @@
+package plain
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func endpoint(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: port}
+}
+
+// idle makes session look idle for d
+func idle(session *Session, d time.Duration) {
+	session.mu.Lock()
+	session.lastSeen = time.Now().Add(-d)
+	session.mu.Unlock()
+}
+
+func TestSessionLookup(t *testing.T) {
+	table := NewSessionTable(time.Minute)
+	session := table.Open("laptop", []string{"10.108.0.7/24", "fd00:0::7/64"}, endpoint(4000), nil)
+
+	for _, tunnelIP := range []string{"10.108.0.7", "10.108.0.7/24", "fd00::7", "::ffff:10.108.0.7"} {
+		if found, ok := table.Lookup(tunnelIP); !ok || found != session {
+			t.Errorf("no session for %s", tunnelIP)
+		}
+	}
+	if found, ok := table.LookupEndpoint(endpoint(4000)); !ok || found != session {
+		t.Error("no session for the endpoint")
+	}
+	if _, ok := table.Lookup("10.108.0.8"); ok {
+		t.Error("session found for another address")
+	}
+	if sessions := table.Sessions(); len(sessions) != 1 {
+		t.Errorf("a dual-stack client has %d sessions", len(sessions))
+	}
+}
+
+func TestSessionReplaced(t *testing.T) {
+	table := NewSessionTable(time.Minute)
+	first := table.Open("laptop", []string{"10.108.0.7"}, endpoint(4000), nil)
+	second := table.Open("laptop", []string{"10.108.0.7"}, endpoint(4001), nil)
+	if found, ok := table.Lookup("10.108.0.7"); !ok || found != second {
+		t.Error("the new session did not replace the old one")
+	}
+	if _, ok := table.LookupEndpoint(endpoint(4000)); ok {
+		t.Error("the old endpoint still has a session")
+	}
+	table.Remove(first)
+	if _, ok := table.Lookup("10.108.0.7"); !ok {
+		t.Error("removing the replaced session dropped the new one")
+	}
+}
+
+func TestSessionRoaming(t *testing.T) {
+	table := NewSessionTable(time.Minute)
+	session := table.Open("laptop", []string{"10.108.0.7"}, endpoint(4000), nil)
+	other := table.Open("phone", []string{"10.108.0.8"}, endpoint(5000), nil)
+
+	table.Touch(session, endpoint(4001))
+	if session.Endpoint().String() != endpoint(4001).String() {
+		t.Errorf("endpoint %s after roaming", session.Endpoint())
+	}
+	if found, ok := table.LookupEndpoint(endpoint(4001)); !ok || found != session {
+		t.Error("no session at the new endpoint")
+	}
+	if _, ok := table.LookupEndpoint(endpoint(4000)); ok {
+		t.Error("session still found at the old endpoint")
+	}
+
+	// A client roaming onto an endpoint another client left must not unindex it when it moves on
+	table.Touch(other, endpoint(4000))
+	table.Touch(session, endpoint(4002))
+	if found, ok := table.LookupEndpoint(endpoint(4000)); !ok || found != other {
+		t.Error("the other client lost its endpoint")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	table := NewSessionTable(time.Minute)
+	stale := table.Open("laptop", []string{"10.108.0.7"}, endpoint(4000), nil)
+	fresh := table.Open("phone", []string{"10.108.0.8"}, endpoint(5000), nil)
+	idle(stale, 2*time.Minute)
+	idle(fresh, 30*time.Second)
+
+	if _, ok := table.Lookup("10.108.0.7"); ok {
+		t.Error("idle session found by address")
+	}
+	if _, ok := table.LookupEndpoint(endpoint(4000)); ok {
+		t.Error("idle session found by endpoint")
+	}
+	expired := table.Expire()
+	if len(expired) != 1 || expired[0] != stale {
+		t.Fatalf("expired %v", expired)
+	}
+	if sessions := table.Sessions(); len(sessions) != 1 || sessions[0] != fresh {
+		t.Errorf("sessions left %v", sessions)
+	}
+
+	// Traffic keeps a session alive
+	idle(fresh, 2*time.Minute)
+	table.Touch(fresh, endpoint(5000))
+	if expired := table.Expire(); len(expired) != 0 {
+		t.Errorf("expired a session that just sent traffic")
+	}
+}
+
+func TestSessionNoTimeout(t *testing.T) {
+	table := NewSessionTable(0)
+	session := table.Open("laptop", []string{"10.108.0.7"}, endpoint(4000), nil)
+	idle(session, 24*time.Hour)
+	if expired := table.Expire(); len(expired) != 0 {
+		t.Error("sessions expired without a timeout")
+	}
+}
@@ -0,0 +1,85 @@
+package plain
+
+import (
+	"errors"
+	"expvar"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats counts packets the plain transport had to drop
+type Stats struct {
+	AuthFailures atomic.Uint64
+	Replays      atomic.Uint64
+	Malformed    atomic.Uint64
+}
+
+// publishedMetrics makes sure the counters are published once per process, as expvar panics
+// on a name published twice
+var publishedMetrics sync.Once
+
+// publishMetrics publishes the counters over expvar when metrics are enabled. Only the first
+// service started in the process is published.
+func (p *PlainVPN) publishMetrics() {
+	if p.config.MetricsAddress == "" {
+		return
+	}
+	publishedMetrics.Do(func() {
+		expvar.Publish("plain", expvar.Func(p.metrics))
+	})
+}
+
+func (p *PlainVPN) metrics() interface{} {
+	stats, _ := p.Stats()
+	return stats
+}
+
+// Stats returns the dropped packet counters, and the sessions and leases on a server
+func (p *PlainVPN) Stats() (map[string]interface{}, error) {
+	stats := map[string]interface{}{
+		"auth_failures": p.stats.AuthFailures.Load(),
+		"replays":       p.stats.Replays.Load(),
+		"malformed":     p.stats.Malformed.Load(),
+	}
+	if p.sessions != nil {
+		stats["sessions"] = len(p.sessions.Sessions())
+	}
+	if p.pool != nil {
+		stats["leases"] = len(p.pool.Leases())
+	}
+	return stats, nil
+}
+
+// Status lists the client sessions on a server, or the server a client is connected to
+func (p *PlainVPN) Status() (*control.Status, error) {
+	status := &control.Status{Transport: "plain", Mode: "client", Interface: p.config.TunName}
+	if p.config.ServerMode {
+		status.Mode = "server"
+		status.ListenPort, _ = strconv.Atoi(p.config.LocalAddress)
+		if p.sessions == nil {
+			return nil, errors.New("server is not running")
+		}
+		for _, session := range p.sessions.Sessions() {
+			lastSeen := session.LastSeen()
+			status.Peers = append(status.Peers, control.PeerStatus{
+				ID:         session.ClientID,
+				Endpoint:   session.Endpoint().String(),
+				AllowedIPs: session.TunnelIPs,
+				LastSeen:   &lastSeen,
+			})
+		}
+		return status, nil
+	}
+
+	conn := p.currentConn()
+	if conn == nil {
+		return nil, errors.New("not connected to a server")
+	}
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	server := control.PeerStatus{ID: "server", Endpoint: conn.RemoteAddr().String(), AllowedIPs: p.routes.Strings()}
+	status.Peers = append(status.Peers, server)
+	return status, nil
+}
@@ -0,0 +1,20 @@
+package plain
+
+import (
+	"expvar"
+	"github.com/kwakubiney/safehaven/config"
+	"testing"
+)
+
+func TestPublishMetricsOnce(t *testing.T) {
+	(&PlainVPN{config: &config.Config{}}).publishMetrics()
+	if expvar.Get("plain") != nil {
+		t.Fatal("published without metrics enabled")
+	}
+	for i := 0; i < 2; i++ {
+		(&PlainVPN{config: &config.Config{MetricsAddress: "127.0.0.1:9100"}}).publishMetrics()
+	}
+	if expvar.Get("plain") == nil {
+		t.Error("not published with metrics enabled")
+	}
+}
@@ -4,287 +4,210 @@ import (
 	"context"
 	"fmt"
 	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/firewall"
+	"github.com/kwakubiney/safehaven/pkg/ipam"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
 	"github.com/kwakubiney/safehaven/pkg/vpn"
 	"github.com/kwakubiney/safehaven/utils"
 	cmap "github.com/orcaman/concurrent-map/v2"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/chacha20poly1305"
 	"log"
 	"net"
-	"strconv"
+	"net/netip"
 	"sync"
 )
 
 type PlainVPN struct {
 	config    *config.Config
 	tunDevice *water.Interface
+	connMu    sync.RWMutex
 	conn      net.Conn
-	connMap   cmap.ConcurrentMap[string, net.Addr]
-	wg        *sync.WaitGroup
+	sessions  *SessionTable
+	pool      *ipam.Pool
+	tunnelIPs []string
+	routes    *netconf.TunnelRoutes
+	mtu       int
+	cipher    *packetCipher
+	stats     Stats
+	undo      netconf.Undo
+	// killSwitch is set while the kill switch is on
+	killSwitch *firewall.KillSwitch
+	wg         *sync.WaitGroup
+
+	teardownMu sync.Mutex
+	// configMu guards the settings Reload may change while the tunnel is up, and the tunnel
+	// addresses and MTU a client takes on when it reconnects
+	configMu sync.RWMutex
+
+	// serverReplay guards the client against replayed server messages
+	serverReplay *replayWindow
+	// serverIndex picks the server the client dials next
+	serverIndex int
+	// reconnect asks the client to drop the current connection and dial again
+	reconnect chan struct{}
+	// lastHello holds the newest hello timestamp seen per client id
+	lastHello cmap.ConcurrentMap[string, int64]
 }
 
 func NewPlainVPN(config *config.Config) vpn.VPNService {
 	log.Println("Initializing SafeHaven VPN service...")
 	var wg = &sync.WaitGroup{}
-	return &PlainVPN{
-		config: config,
-		wg:     wg,
+	p := &PlainVPN{
+		config:    config,
+		wg:        wg,
+		lastHello: cmap.New[int64](),
+		reconnect: make(chan struct{}, 1),
 	}
+	p.routes = netconf.NewTunnelRoutes(config, &p.undo, func() ([]netip.AddrPort, error) {
+		return firewall.ServerEndpoints(p.config, p.killSwitch)
+	})
+	return p
 }
 
-func (p *PlainVPN) Start(ctx context.Context) error {
-	if p.config.ServerMode {
-		log.Println("Starting VPN in server mode...")
-		return p.startServer(ctx)
+// overhead is what the plain transport adds to every packet: the outer headers, the frame
+// header and, with a pre-shared key, the sealed header and authentication tag
+func (p *PlainVPN) overhead() int {
+	overhead := netconf.OuterHeaderLen + frameHeaderLen
+	if p.cipher != nil {
+		overhead += sealedHeadLen + chacha20poly1305.Overhead
 	}
-	log.Println("Starting VPN in client mode...")
-	return p.startClient(ctx)
+	return overhead
 }
 
-func (p *PlainVPN) Stop() error {
-	p.tunDevice.Close()
-	p.conn.Close()
-	log.Println("VPN service shutdown complete")
-	return nil
-}
+func (p *PlainVPN) Start(ctx context.Context) error {
+	p.publishMetrics()
 
-func (p *PlainVPN) startClient(ctx context.Context) error {
-	log.Println("Setting up TUN interface...")
-	err := p.setTunOnDevice()
-	if err != nil {
-		return err
+	if p.config.PreSharedKeyFile != "" {
+		psk, err := loadPreSharedKey(p.config.PreSharedKeyFile)
+		if err != nil {
+			return err
+		}
+		p.cipher, err = newPacketCipher(psk)
+		if err != nil {
+			return err
+		}
+		log.Println("Pre-shared key loaded - traffic will be encrypted and authenticated")
 	}
-	log.Printf("TUN interface %s created successfully", p.config.TunName)
 
-	log.Println("Configuring TUN IP address...")
-	err = p.assignIPToTun()
+	var err error
+	if p.config.ServerMode {
+		log.Println("Starting VPN in server mode...")
+		err = p.startServer(ctx)
+	} else {
+		log.Println("Starting VPN in client mode...")
+		err = p.startClient(ctx)
+	}
 	if err != nil {
-		return err
+		log.Println("Startup failed, reverting network changes...")
+		if teardownErr := p.teardown(); teardownErr != nil {
+			log.Printf("Error during teardown: %v", teardownErr)
+		}
 	}
-	log.Printf("TUN interface IP configured: %s", p.config.ClientTunIP)
+	return err
+}
 
-	log.Println("Setting up network routes...")
-	err = p.createRoutes()
-	if err != nil {
-		return err
+func (p *PlainVPN) Stop() error {
+	p.sayGoodbye()
+	err := p.teardown()
+	if p.cipher != nil {
+		log.Printf("Dropped %d packets failing authentication and %d replayed packets",
+			p.stats.AuthFailures.Load(), p.stats.Replays.Load())
 	}
-	if p.config.Global {
-		log.Println("Global routing enabled - all traffic will go through VPN")
-	} else {
-		log.Printf("Route to %s configured through VPN", p.config.DestinationAddress)
+	if malformed := p.stats.Malformed.Load(); malformed > 0 {
+		log.Printf("Dropped %d malformed packets", malformed)
 	}
+	log.Println("VPN service shutdown complete")
+	return err
+}
 
-	packet := make([]byte, 65535)
-	log.Printf("Connecting to VPN server at %s...", p.config.ServerAddress)
-	clientConn, err := net.Dial("udp", p.config.ServerAddress)
-	p.conn = clientConn
+// teardown reverts the routes and addresses we added, newest first, then closes the
+// TUN device and socket. It is safe to call more than once.
+func (p *PlainVPN) teardown() error {
+	p.teardownMu.Lock()
+	defer p.teardownMu.Unlock()
 
-	if err != nil {
-		return err
-	}
-	log.Println("Connected to VPN server successfully")
-
-	p.wg.Add(1)
-	//receive
-	go func() {
-		defer p.wg.Done()
-		log.Println("Started receive handler")
-		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("Exiting loop...")
-				return
-			default:
-				packet := make([]byte, 65535)
-				n, err := clientConn.Read(packet)
-				if err != nil {
-					log.Printf("Error receiving data: %v", err)
-					continue
-				}
-				_, err = p.tunDevice.Write(packet[:n])
-				if err != nil {
-					log.Printf("Error writing to TUN: %v", err)
-					continue
-				}
-			}
+	if p.sessions != nil {
+		for _, session := range p.sessions.Sessions() {
+			p.retireClient(session)
 		}
-	}()
-
-	//send
-	p.wg.Add(1)
-	log.Println("Started send handler")
-	go func() {
-		defer p.wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("Exiting loop...")
-				return
-			default:
-				n, err := p.tunDevice.Read(packet)
-				if err != nil {
-					log.Printf("Error reading from TUN: %v", err)
-					break
-				}
+	}
+	err := p.undo.Run()
+	if p.tunDevice != nil {
+		p.tunDevice.Close()
+	}
+	if conn := p.currentConn(); conn != nil {
+		conn.Close()
+	}
+	return err
+}
 
-				_, err = clientConn.Write(packet[:n])
-				if err != nil {
-					log.Printf("Error sending data: %v", err)
-					continue
-				}
-			}
-		}
-	}()
+// currentConn returns the socket to the server, or the listening socket in server mode
+func (p *PlainVPN) currentConn() net.Conn {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+	return p.conn
+}
 
-	// Wait for context cancellation
-	<-ctx.Done()
-	log.Println("VPN client shutting down...")
-	return nil
+func (p *PlainVPN) setConn(conn net.Conn) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.conn = conn
 }
 
-func (p *PlainVPN) startServer(ctx context.Context) error {
-	log.Println("Setting up TUN interface...")
-	err := p.setTunOnDevice()
-	if err != nil {
-		return err
+// sayGoodbye tells the other end of every session that we are going away
+func (p *PlainVPN) sayGoodbye() {
+	conn := p.currentConn()
+	if conn == nil {
+		return
 	}
-	log.Printf("TUN interface %s created successfully", p.config.TunName)
-
-	p.connMap = cmap.New[net.Addr]()
-
-	log.Println("Configuring TUN IP address...")
-	err = p.assignIPToTun()
+	bye, err := encodeControl(messageBye, nil)
 	if err != nil {
-		return err
+		return
 	}
-	log.Printf("TUN interface IP configured: %s", p.config.ServerTunIP)
-
-	log.Println("Setting up network routes...")
-	err = p.createRoutes()
-	if err != nil {
-		return err
+	bye = p.seal(bye)
+	if !p.config.ServerMode {
+		conn.Write(bye)
+		return
 	}
-	log.Printf("Route to client (%s) configured", utils.RemoveCIDRSuffix(p.config.ClientTunIP, "/"))
-
-	localAddress, _ := strconv.Atoi(p.config.LocalAddress)
-	log.Printf("Starting UDP server on port %d...", localAddress)
-	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localAddress})
-	p.conn = serverConn
-	if err != nil {
-		return err
+	serverConn := conn.(*net.UDPConn)
+	for _, session := range p.sessions.Sessions() {
+		serverConn.WriteToUDP(bye, session.Endpoint())
 	}
-	log.Printf("UDP server listening on port %d", localAddress)
-	p.wg.Add(1)
-	go func() {
-		defer p.wg.Done()
-		log.Println("Started client receive handler")
-		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("Exiting loop...")
-				return
-			default:
-				packet := make([]byte, 65535)
-				n, clientAddr, err := serverConn.ReadFrom(packet)
-				if err != nil {
-					log.Printf("Error receiving from client: %v", err)
-					continue
-				}
-				sourceIPAddress := utils.ResolveSourceIPAddressFromRawPacket(packet)
-
-				p.connMap.Set(sourceIPAddress, clientAddr)
-
-				_, err = p.tunDevice.Write(packet[:n])
-				if err != nil {
-					log.Printf("Error writing to TUN: %v", err)
-					continue
-				}
-			}
-		}
-	}()
-
-	log.Println("Started client send handler")
-	p.wg.Add(1)
-	go func() {
-		defer p.wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("Exiting loop...")
-				return
-			default:
-				packet := make([]byte, 1500)
-				n, err := p.tunDevice.Read(packet)
-				if err != nil {
-					log.Printf("Error reading from TUN: %v", err)
-					break
-				}
-
-				destinationIPAddress := utils.ResolveDestinationIPAddressFromRawPacket(packet)
-				destinationUDPAddress, ok := p.connMap.Get(destinationIPAddress)
-				if ok {
-					_, err = serverConn.WriteToUDP(packet[:n], destinationUDPAddress.(*net.UDPAddr))
-					if err != nil {
-						log.Printf("Error sending to client %s: %v", destinationUDPAddress.String(), err)
-						continue
-					}
-
-					p.connMap.Remove(destinationIPAddress)
-				}
-			}
-		}
-	}()
-
-	// Wait for context cancellation
-	<-ctx.Done()
-	log.Println("VPN server shutting down...")
-	return nil
 }
 
+// assignIPToTun configures the negotiated tunnel address and MTU on the TUN interface
 func (p *PlainVPN) assignIPToTun() error {
-	if !p.config.ServerMode {
-		tunLink, err := netlink.LinkByName(p.config.TunName)
-		if err != nil {
-			return err
-		}
-
-		parsedTunIPAddress, err := netlink.ParseAddr(p.config.ClientTunIP)
-		if err != nil {
-			return err
-		}
+	tunLink, err := netlink.LinkByName(p.config.TunName)
+	if err != nil {
+		return err
+	}
 
-		err = netlink.AddrAdd(tunLink, parsedTunIPAddress)
+	for _, tunnelIP := range p.tunnelIPs {
+		parsedTunIPAddress, err := netlink.ParseAddr(tunnelIP)
 		if err != nil {
 			return err
 		}
 
-		err = netlink.LinkSetUp(tunLink)
-		if err != nil {
-			return err
-		}
-		log.Printf("TUN interface %s is up with IP %s", p.config.TunName, p.config.ClientTunIP)
-	} else {
-		tunLink, err := netlink.LinkByName(p.config.TunName)
-		if err != nil {
-			return err
-		}
-
-		parsedTunIPAddress, err := netlink.ParseAddr(p.config.ServerTunIP)
+		err = p.undo.AddrAdd(tunLink, parsedTunIPAddress)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = netlink.AddrAdd(tunLink, parsedTunIPAddress)
+	if p.mtu > 0 {
+		err = netlink.LinkSetMTU(tunLink, p.mtu)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = netlink.LinkSetUp(tunLink)
-		if err != nil {
-			return err
-		}
-		log.Printf("TUN interface %s is up with IP %s", p.config.TunName, p.config.ServerTunIP)
+	err = p.undo.LinkSetUp(tunLink)
+	if err != nil {
+		return err
 	}
+	log.Printf("TUN interface %s is up with IPs %v and MTU %d", p.config.TunName, p.tunnelIPs, p.mtu)
 	return nil
 }
 
@@ -296,54 +219,39 @@ func (p *PlainVPN) createRoutes() error {
 	}
 
 	if !p.config.ServerMode {
-		if p.config.Global {
-			// Add default route (0.0.0.0/0) with lower metric to override existing default route
-			defaultDst, _ := netlink.ParseIPNet("0.0.0.0/0")
-			defaultRoute := &netlink.Route{
-				LinkIndex: link.Attrs().Index,
-				Dst:       defaultDst,
-				Priority:  50,
+		routes, err := netconf.ClientRoutes(p.config, p.tunnelIPs)
+		if err != nil {
+			return err
+		}
+		if err := p.routes.Add(routes); err != nil {
+			return err
+		}
+		if p.config.RouteTable != 0 {
+			if err := p.undo.AddPolicyRules(p.config.RouteTable, p.config.FwMark, routes); err != nil {
+				return err
 			}
+		}
+	} else if p.pool == nil {
+		// Server mode: Add route to reply back to client
+		for _, clientTunIP := range utils.SplitAddressList(p.config.ClientTunIP) {
+			// Parse client IP without CIDR suffix
+			clientIP := utils.RemoveCIDRSuffix(clientTunIP, "/")
 
-			if err := netlink.RouteAdd(defaultRoute); err != nil {
-				return fmt.Errorf("failed to add default route with lower metric: %w", err)
-			}
-			log.Println("Added global route - all traffic will go through the VPN")
-		} else {
-			// Add route for specific destination through TUN
-			dst, err := netlink.ParseIPNet(p.config.DestinationAddress)
+			// Create a /32 or /128 network for the single IP
+			dst, err := utils.ParsePrefix(clientIP)
 			if err != nil {
-				return fmt.Errorf("invalid destination address %s: %w", p.config.DestinationAddress, err)
+				return fmt.Errorf("invalid client IP %s: %w", clientIP, err)
 			}
 
 			route := &netlink.Route{
 				LinkIndex: link.Attrs().Index,
 				Dst:       dst,
 			}
-			if err := netlink.RouteAdd(route); err != nil {
-				return fmt.Errorf("failed to add route for %s: %w", p.config.DestinationAddress, err)
+			if err := p.undo.RouteAdd(route); err != nil {
+				return fmt.Errorf("failed to add route for client %s: %w", clientIP, err)
 			}
-			log.Printf("Added route for %s through the VPN", p.config.DestinationAddress)
-		}
-	} else {
-		// Server mode: Add route to reply back to client
-		// Parse client IP without CIDR suffix
-		clientIP := utils.RemoveCIDRSuffix(p.config.ClientTunIP, "/")
-
-		// Create a /32 network for the single IP
-		dst, err := netlink.ParseIPNet(clientIP + "/32")
-		if err != nil {
-			return fmt.Errorf("invalid client IP %s: %w", clientIP, err)
-		}
-
-		route := &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst:       dst,
-		}
-		if err := netlink.RouteAdd(route); err != nil {
-			return fmt.Errorf("failed to add route for client %s: %w", clientIP, err)
+			log.Printf("Added route for client %s", clientIP)
 		}
-		log.Printf("Added route for client %s", clientIP)
 	}
 
 	return nil
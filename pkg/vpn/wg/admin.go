@@ -0,0 +1,103 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"github.com/kwakubiney/safehaven/pkg/firewall"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+)
+
+var _ control.Admin = (*WireGuardVPN)(nil)
+
+// Stats sums the transfer counters of all peers
+func (w *WireGuardVPN) Stats() (map[string]interface{}, error) {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return nil, errors.New("WireGuard device is not running")
+	}
+	state, err := w.wgDevice.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	var rxBytes, txBytes uint64
+	peers := parseIpcGet(state).Peers
+	for _, peer := range peers {
+		rxBytes += peer.RxBytes
+		txBytes += peer.TxBytes
+	}
+	return map[string]interface{}{"peers": len(peers), "rx_bytes": rxBytes, "tx_bytes": txBytes}, nil
+}
+
+// AddRoute routes dst through the tunnel and allows it from the server
+func (w *WireGuardVPN) AddRoute(dst string) error {
+	return w.changeRoutes(func() error {
+		return w.routes.AddRoute(dst)
+	})
+}
+
+// RemoveRoute stops routing dst through the tunnel
+func (w *WireGuardVPN) RemoveRoute(dst string) error {
+	return w.changeRoutes(func() error {
+		return w.routes.RemoveRoute(dst)
+	})
+}
+
+func (w *WireGuardVPN) changeRoutes(change func() error) error {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return errors.New("WireGuard device is not running")
+	}
+	if w.config.ServerMode {
+		return errors.New("routes can only be changed on a client, servers route the allowed IPs of their peers")
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return w.updateServerPeer()
+}
+
+// Reconnect resolves the server address again, in case it moved, and starts a fresh
+// handshake instead of waiting for the current session to expire
+func (w *WireGuardVPN) Reconnect() error {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return errors.New("WireGuard device is not running")
+	}
+	if w.config.ServerMode {
+		return errors.New("only clients can reconnect")
+	}
+
+	endpoints, err := firewall.ServerEndpoints(w.config, w.killSwitch)
+	if err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("server address %s did not resolve", w.config.ServerAddress)
+	}
+	serverKey, err := wgtypes.ParseKey(w.config.WireGuardConfig.ServerPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid server public key: %w", err)
+	}
+	request := fmt.Sprintf("public_key=%x\nupdate_only=true\nendpoint=%s\n", serverKey[:], endpoints[0])
+	if err := w.wgDevice.IpcSet(request); err != nil {
+		return fmt.Errorf("failed to update the server endpoint: %w", err)
+	}
+
+	peer := w.wgDevice.LookupPeer(device.NoisePublicKey(serverKey))
+	if peer == nil {
+		return errors.New("server peer is not configured")
+	}
+	peer.ExpireCurrentKeypairs()
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		return fmt.Errorf("failed to start a handshake: %w", err)
+	}
+	log.Printf("Started a new handshake with the server at %s", endpoints[0])
+	return nil
+}
@@ -0,0 +1,106 @@
+package wg
+
+import (
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/wg"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+// testDevice returns a WireGuard device on an in-memory TUN, which is enough for the UAPI
+func testDevice(t *testing.T) *device.Device {
+	t.Helper()
+	wgDevice := device.NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(wgDevice.Close)
+	return wgDevice
+}
+
+func TestAdminWithoutDevice(t *testing.T) {
+	w := &WireGuardVPN{config: &config.Config{}}
+	if _, err := w.Stats(); err == nil {
+		t.Error("stats without a device")
+	}
+	if _, err := w.Status(); err == nil {
+		t.Error("status without a device")
+	}
+	if err := w.AddPeer(config.Peer{ID: "laptop"}); err == nil {
+		t.Error("added a peer without a device")
+	}
+	if err := w.RemovePeer("laptop"); err == nil {
+		t.Error("removed a peer without a device")
+	}
+	if err := w.AddRoute("10.0.0.0/8"); err == nil {
+		t.Error("added a route without a device")
+	}
+	if err := w.Reconnect(); err == nil {
+		t.Error("reconnected without a device")
+	}
+}
+
+func TestAdminModeChecks(t *testing.T) {
+	server := &WireGuardVPN{config: &config.Config{ServerMode: true, WireGuardConfig: &wg.WireGuardConfig{}}, wgDevice: testDevice(t)}
+	if err := server.AddRoute("10.0.0.0/8"); err == nil {
+		t.Error("server added a route")
+	}
+	if err := server.RemoveRoute("10.0.0.0/8"); err == nil {
+		t.Error("server removed a route")
+	}
+	if err := server.Reconnect(); err == nil {
+		t.Error("server reconnected")
+	}
+	if err := server.RemovePeer("laptop"); err == nil {
+		t.Error("removed a peer that does not exist")
+	}
+
+	client := &WireGuardVPN{config: &config.Config{WireGuardConfig: &wg.WireGuardConfig{}}, wgDevice: testDevice(t)}
+	if err := client.AddPeer(config.Peer{ID: "laptop"}); err == nil {
+		t.Error("client added a peer")
+	}
+}
+
+func TestStatsAndStatus(t *testing.T) {
+	deviceKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &WireGuardVPN{
+		config: &config.Config{
+			ServerMode:      true,
+			TunName:         "wg0",
+			WireGuardConfig: &wg.WireGuardConfig{},
+			Peers:           []config.Peer{{ID: "laptop", PublicKey: peerKey.PublicKey().String()}},
+		},
+		wgDevice: testDevice(t),
+	}
+	publicKey := peerKey.PublicKey()
+	request := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=10.108.0.2/32\n", deviceKey[:], publicKey[:])
+	if err := w.wgDevice.IpcSet(request); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := w.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["peers"] != 1 || stats["rx_bytes"] != uint64(0) {
+		t.Errorf("got stats %v", stats)
+	}
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Mode != "server" || status.Interface != "wg0" || status.PublicKey != deviceKey.PublicKey().String() || len(status.Peers) != 1 {
+		t.Fatalf("got status %+v", status)
+	}
+	if peer := status.Peers[0]; peer.ID != "laptop" || peer.PublicKey != publicKey.String() {
+		t.Errorf("got peer %+v", peer)
+	}
+}
@@ -0,0 +1,197 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// AddPeer adds a peer to the running server, or updates it if its id is already known.
+// Peers added this way last until the next reload or restart.
+func (w *WireGuardVPN) AddPeer(peer config.Peer) error {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return errors.New("WireGuard device is not running")
+	}
+	if !w.config.ServerMode {
+		return errors.New("peers can only be added in server mode")
+	}
+	if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+		return fmt.Errorf("invalid public key for peer %s: %w", peer.ID, err)
+	}
+	if len(peerAllowedIPs(peer)) == 0 {
+		return fmt.Errorf("peer %s needs allowed IPs or tunnel IPs", peer.ID)
+	}
+
+	peers := []config.Peer{peer}
+	var replaced *config.Peer
+	for i, existing := range w.config.Peers {
+		switch {
+		case existing.ID == peer.ID:
+			replaced = &w.config.Peers[i]
+		case existing.PublicKey == peer.PublicKey:
+			return fmt.Errorf("public key of peer %s is already used by peer %s", peer.ID, existing.ID)
+		default:
+			peers = append(peers, existing)
+		}
+	}
+	if err := w.setPeer(peer); err != nil {
+		return err
+	}
+	if replaced != nil && replaced.PublicKey != peer.PublicKey {
+		if err := w.removePeer(replaced.PublicKey); err != nil {
+			return err
+		}
+	}
+	w.config.Peers = peers
+	return nil
+}
+
+// RemovePeer removes the peer with the given id from the running server
+func (w *WireGuardVPN) RemovePeer(id string) error {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return errors.New("WireGuard device is not running")
+	}
+
+	var peers []config.Peer
+	removed := false
+	for _, existing := range w.config.Peers {
+		if existing.ID != id {
+			peers = append(peers, existing)
+			continue
+		}
+		if err := w.removePeer(existing.PublicKey); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return fmt.Errorf("no peer with id %s", id)
+	}
+	w.config.Peers = peers
+	return nil
+}
+
+// setupPeers configures every peer in the configuration on a freshly created device
+func (w *WireGuardVPN) setupPeers() error {
+	for _, peer := range w.config.Peers {
+		if err := w.setPeer(peer); err != nil {
+			return err
+		}
+	}
+	if len(w.config.Peers) > 0 {
+		log.Printf("Configured %d WireGuard peers", len(w.config.Peers))
+	}
+	return nil
+}
+
+// setPeer adds or replaces a peer on the device and routes its allowed IPs through the tunnel
+func (w *WireGuardVPN) setPeer(peer config.Peer) error {
+	request, err := peerRequest(peer)
+	if err != nil {
+		return err
+	}
+	if err := w.wgDevice.IpcSet(request); err != nil {
+		return fmt.Errorf("failed to configure peer %s: %w", peer.ID, err)
+	}
+	if err := w.removePeerRoutes(peer.PublicKey); err != nil {
+		return err
+	}
+	return w.addPeerRoutes(peer)
+}
+
+// removePeer removes a peer from the device along with its routes
+func (w *WireGuardVPN) removePeer(publicKey string) error {
+	key, err := base64ToHex(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert public key to hexadecimal: %w", err)
+	}
+	if err := w.wgDevice.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", key)); err != nil {
+		return fmt.Errorf("failed to remove peer: %w", err)
+	}
+	return w.removePeerRoutes(publicKey)
+}
+
+// addPeerRoutes routes the peer's allowed IPs through the tunnel. Routes that already exist,
+// such as the one for a legacy client address, are left to whoever added them.
+func (w *WireGuardVPN) addPeerRoutes(peer config.Peer) error {
+	link, err := netlink.LinkByName(w.config.TunName)
+	if err != nil {
+		return fmt.Errorf("failed to get TUN interface %s: %w", w.config.TunName, err)
+	}
+	for _, allowedIP := range peerAllowedIPs(peer) {
+		dst, err := utils.ParsePrefix(allowedIP)
+		if err != nil {
+			return fmt.Errorf("invalid allowed IP %s for peer %s: %w", allowedIP, peer.ID, err)
+		}
+		err = w.undo.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst})
+		if errors.Is(err, syscall.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add route for peer %s: %w", peer.ID, err)
+		}
+		if w.peerRoutes == nil {
+			w.peerRoutes = map[string][]*net.IPNet{}
+		}
+		w.peerRoutes[peer.PublicKey] = append(w.peerRoutes[peer.PublicKey], dst)
+	}
+	return nil
+}
+
+func (w *WireGuardVPN) removePeerRoutes(publicKey string) error {
+	link, err := netlink.LinkByName(w.config.TunName)
+	if err != nil {
+		return fmt.Errorf("failed to get TUN interface %s: %w", w.config.TunName, err)
+	}
+	for _, dst := range w.peerRoutes[publicKey] {
+		err := netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst})
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to remove route for %s: %w", dst, err)
+		}
+	}
+	delete(w.peerRoutes, publicKey)
+	return nil
+}
+
+// peerRequest renders the UAPI request that adds the peer, or replaces its settings if it
+// already exists
+func peerRequest(peer config.Peer) (string, error) {
+	publicKey, err := base64ToHex(peer.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert public key of peer %s to hexadecimal: %w", peer.ID, err)
+	}
+	peerSettings, err := peerSettingsRequest(peer.PresharedKey, peer.PersistentKeepalive)
+	if err != nil {
+		return "", fmt.Errorf("peer %s: %w", peer.ID, err)
+	}
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "public_key=%s\n", publicKey)
+	request.WriteString(peerSettings)
+	request.WriteString("replace_allowed_ips=true\n")
+	request.WriteString(allowedIPsRequest(peerAllowedIPs(peer)))
+	return request.String(), nil
+}
+
+// peerAllowedIPs are the peer's allowed IPs, or its tunnel addresses as host routes
+func peerAllowedIPs(peer config.Peer) []string {
+	if len(peer.AllowedIPs) > 0 {
+		return peer.AllowedIPs
+	}
+	var allowedIPs []string
+	for _, tunnelIP := range peer.TunnelIPs {
+		allowedIPs = append(allowedIPs, utils.RemoveCIDRSuffix(tunnelIP, "/"))
+	}
+	return allowedIPs
+}
@@ -0,0 +1,41 @@
+package wg
+
+import (
+	"github.com/kwakubiney/safehaven/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"reflect"
+	"testing"
+)
+
+func TestAddPeerRejects(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := config.Peer{ID: "laptop", PublicKey: key.PublicKey().String(), TunnelIPs: []string{"10.108.0.2"}}
+	w := &WireGuardVPN{
+		config:   &config.Config{ServerMode: true, Peers: []config.Peer{existing}},
+		wgDevice: testDevice(t),
+	}
+
+	other, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		peer config.Peer
+	}{
+		{"invalid public key", config.Peer{ID: "phone", PublicKey: "key", TunnelIPs: []string{"10.108.0.3"}}},
+		{"no allowed IPs", config.Peer{ID: "phone", PublicKey: other.PublicKey().String()}},
+		{"public key of another peer", config.Peer{ID: "phone", PublicKey: existing.PublicKey, TunnelIPs: []string{"10.108.0.3"}}},
+	}
+	for _, test := range tests {
+		if err := w.AddPeer(test.peer); err == nil {
+			t.Errorf("%s: added", test.name)
+		}
+		if !reflect.DeepEqual(w.config.Peers, []config.Peer{existing}) {
+			t.Fatalf("%s: peers changed to %v", test.name, w.config.Peers)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
+	"github.com/kwakubiney/safehaven/utils"
+	"github.com/kwakubiney/safehaven/wg"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// Reload applies a changed configuration through the UAPI without taking the WireGuard device
+// or TUN interface down. Settings that need a restart are logged and left alone.
+func (w *WireGuardVPN) Reload(cfg *config.Config) error {
+	for _, setting := range w.config.RestartRequired(cfg) {
+		log.Printf("Changed %s only takes effect after a restart", setting)
+	}
+
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return errors.New("WireGuard device is not running")
+	}
+	if w.config.ServerMode {
+		return w.reloadServer(cfg)
+	}
+	return w.reloadClient(cfg)
+}
+
+// reloadServer removes the peers that are gone, sets the ones that were added or changed, and
+// swaps the legacy client peer if its key changed
+func (w *WireGuardVPN) reloadServer(cfg *config.Config) error {
+	removed, changed := diffPeers(w.config.Peers, cfg.Peers)
+	for _, peer := range removed {
+		if err := w.removePeer(peer.PublicKey); err != nil {
+			return err
+		}
+		log.Printf("Removed peer %s", peer.ID)
+	}
+	for _, peer := range changed {
+		if err := w.setPeer(peer); err != nil {
+			return err
+		}
+		log.Printf("Configured peer %s", peer.ID)
+	}
+
+	if err := w.reloadClientPeer(w.config.WireGuardConfig, cfg.WireGuardConfig); err != nil {
+		return err
+	}
+	w.config.Reload(cfg)
+	return nil
+}
+
+// diffPeers returns the peers of previous that are gone from next and the peers of next that
+// are new or changed, matching them by public key
+func diffPeers(previous, next []config.Peer) (removed, changed []config.Peer) {
+	nextByKey := map[string]config.Peer{}
+	for _, peer := range next {
+		nextByKey[peer.PublicKey] = peer
+	}
+	previousByKey := map[string]config.Peer{}
+	for _, peer := range previous {
+		previousByKey[peer.PublicKey] = peer
+		if _, ok := nextByKey[peer.PublicKey]; !ok {
+			removed = append(removed, peer)
+		}
+	}
+	for _, peer := range next {
+		if existing, ok := previousByKey[peer.PublicKey]; !ok || !reflect.DeepEqual(existing, peer) {
+			changed = append(changed, peer)
+		}
+	}
+	return removed, changed
+}
+
+// reloadClientPeer swaps the client peer from the WireGuard configuration file if its key
+// changed and replaces its allowed IPs
+func (w *WireGuardVPN) reloadClientPeer(previous, next *wg.WireGuardConfig) error {
+	var request strings.Builder
+	if previous.ClientPublicKey != "" && previous.ClientPublicKey != next.ClientPublicKey {
+		previousKey, err := base64ToHex(previous.ClientPublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to convert public key to hexadecimal: %w", err)
+		}
+		fmt.Fprintf(&request, "public_key=%s\nremove=true\n", previousKey)
+		log.Println("Replacing the client peer with its new public key")
+	}
+	if next.ClientPublicKey != "" {
+		nextKey, err := base64ToHex(next.ClientPublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to convert public key to hexadecimal: %w", err)
+		}
+		peerSettings, err := peerSettingsRequest(next.PresharedKey, next.PersistentKeepalive)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&request, "public_key=%s\n%sreplace_allowed_ips=true\n", nextKey, peerSettings)
+		request.WriteString(allowedIPsRequest(utils.SplitAddressList(next.ServerAllowedIPs)))
+	}
+	if request.Len() == 0 {
+		return nil
+	}
+	if err := w.wgDevice.IpcSet(request.String()); err != nil {
+		return fmt.Errorf("failed to update WireGuard peers: %w", err)
+	}
+	return nil
+}
+
+// reloadClient brings the routes through the tunnel, and the server's allowed IPs with them,
+// in line with the new configuration, and applies a changed preshared key or keepalive
+func (w *WireGuardVPN) reloadClient(cfg *config.Config) error {
+	next, err := netconf.ClientRoutes(cfg, utils.SplitAddressList(w.config.ClientTunIP))
+	if err != nil {
+		return err
+	}
+	w.config.Reload(cfg)
+	if err := w.routes.Set(next); err != nil {
+		return err
+	}
+	return w.updateServerPeer()
+}
+
+// updateServerPeer allows exactly the routes through the tunnel from the server peer, and
+// applies its current preshared key and keepalive
+func (w *WireGuardVPN) updateServerPeer() error {
+	serverKey, err := base64ToHex(w.config.WireGuardConfig.ServerPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert public key to hexadecimal: %w", err)
+	}
+	peerSettings, err := peerSettingsRequest(w.config.WireGuardConfig.PresharedKey, w.config.WireGuardConfig.PersistentKeepalive)
+	if err != nil {
+		return err
+	}
+	request := fmt.Sprintf("public_key=%s\nupdate_only=true\n%sreplace_allowed_ips=true\n%s",
+		serverKey, peerSettings, allowedIPsRequest(w.routes.Strings()))
+	if err := w.wgDevice.IpcSet(request); err != nil {
+		return fmt.Errorf("failed to update allowed IPs: %w", err)
+	}
+	log.Printf("Routes through the VPN are now %v", w.routes.Strings())
+	return nil
+}
@@ -0,0 +1,111 @@
+package wg
+
+import (
+	"encoding/hex"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/wg"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// devicePeers returns the allowed IPs of every peer on the device, by hexadecimal public key
+func devicePeers(t *testing.T, wgDevice *device.Device) map[string][]string {
+	t.Helper()
+	state, err := wgDevice.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := map[string][]string{}
+	var current string
+	for _, line := range strings.Split(state, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "public_key":
+			current = value
+			peers[current] = []string{}
+		case "allowed_ip":
+			peers[current] = append(peers[current], value)
+		}
+	}
+	return peers
+}
+
+// publicKey returns a new public key in base64 and hexadecimal
+func publicKey(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := key.PublicKey()
+	return publicKey.String(), hex.EncodeToString(publicKey[:])
+}
+
+func TestReloadServerSwapsClientPeer(t *testing.T) {
+	previousKey, _ := publicKey(t)
+	nextKey, nextHex := publicKey(t)
+	w := &WireGuardVPN{
+		config: &config.Config{ServerMode: true, WireGuardConfig: &wg.WireGuardConfig{
+			ClientPublicKey:  previousKey,
+			ServerAllowedIPs: "10.108.0.2/32",
+		}},
+		wgDevice: testDevice(t),
+	}
+	if err := w.reloadClientPeer(&wg.WireGuardConfig{}, w.config.WireGuardConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	next := &config.Config{ServerMode: true, WireGuardConfig: &wg.WireGuardConfig{
+		ClientPublicKey:  nextKey,
+		ServerAllowedIPs: "10.108.0.2/32, 10.0.0.0/8",
+	}}
+	if err := w.reloadServer(next); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{nextHex: {"10.108.0.2/32", "10.0.0.0/8"}}
+	if got := devicePeers(t, w.wgDevice); !reflect.DeepEqual(got, want) {
+		t.Errorf("device peers %v, want %v", got, want)
+	}
+	if w.config.WireGuardConfig != next.WireGuardConfig {
+		t.Error("the new configuration was not taken on")
+	}
+
+	// Changing only the allowed IPs keeps the peer
+	next = &config.Config{ServerMode: true, WireGuardConfig: &wg.WireGuardConfig{ClientPublicKey: nextKey, ServerAllowedIPs: "10.108.0.2/32"}}
+	if err := w.reloadServer(next); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string][]string{nextHex: {"10.108.0.2/32"}}
+	if got := devicePeers(t, w.wgDevice); !reflect.DeepEqual(got, want) {
+		t.Errorf("device peers %v, want %v", got, want)
+	}
+}
+
+func TestDiffPeers(t *testing.T) {
+	desktop := config.Peer{ID: "desktop", PublicKey: "desktop-key", TunnelIPs: []string{"10.108.0.2"}}
+	laptop := config.Peer{ID: "laptop", PublicKey: "laptop-key", TunnelIPs: []string{"10.108.0.3"}}
+	printer := config.Peer{ID: "printer", PublicKey: "printer-key", TunnelIPs: []string{"10.108.0.4"}}
+	movedLaptop := laptop
+	movedLaptop.TunnelIPs = []string{"10.108.0.13"}
+	phone := config.Peer{ID: "phone", PublicKey: "phone-key", TunnelIPs: []string{"10.108.0.5"}}
+	// A peer that keeps its id but gets a new key is removed and added again
+	rekeyedPrinter := printer
+	rekeyedPrinter.PublicKey = "new-printer-key"
+
+	removed, changed := diffPeers(
+		[]config.Peer{desktop, laptop, printer},
+		[]config.Peer{desktop, movedLaptop, phone, rekeyedPrinter},
+	)
+	if want := []config.Peer{printer}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	if want := []config.Peer{movedLaptop, phone, rekeyedPrinter}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed %v, want %v", changed, want)
+	}
+	if removed, changed := diffPeers([]config.Peer{desktop}, []config.Peer{desktop}); removed != nil || changed != nil {
+		t.Errorf("unchanged peers: removed %v, changed %v", removed, changed)
+	}
+}
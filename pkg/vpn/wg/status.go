@@ -0,0 +1,109 @@
+package wg
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status reads the device state back through the UAPI, naming peers after the configuration
+func (w *WireGuardVPN) Status() (*control.Status, error) {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+	if w.wgDevice == nil {
+		return nil, errors.New("WireGuard device is not running")
+	}
+	state, err := w.wgDevice.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	status := parseIpcGet(state)
+	status.Transport = "wireguard"
+	status.Mode = "client"
+	if w.config.ServerMode {
+		status.Mode = "server"
+	}
+	status.Interface = w.config.TunName
+	names := map[string]string{
+		w.config.WireGuardConfig.ClientPublicKey: "client",
+		w.config.WireGuardConfig.ServerPublicKey: "server",
+	}
+	for _, peer := range w.config.Peers {
+		names[peer.PublicKey] = peer.ID
+	}
+	for i := range status.Peers {
+		status.Peers[i].ID = names[status.Peers[i].PublicKey]
+	}
+	return status, nil
+}
+
+// parseIpcGet parses the UAPI get response: device keys first, then one block of keys per
+// peer starting with public_key. Keys are converted from hex to the usual base64.
+func parseIpcGet(state string) *control.Status {
+	status := &control.Status{}
+	var peer *control.PeerStatus
+	var handshakeSec, handshakeNsec int64
+	flushHandshake := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			handshake := time.Unix(handshakeSec, handshakeNsec)
+			peer.LatestHandshake = &handshake
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	for _, line := range strings.Split(state, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "private_key":
+			if private, err := hex.DecodeString(value); err == nil {
+				if key, err := wgtypes.NewKey(private); err == nil {
+					status.PublicKey = key.PublicKey().String()
+				}
+			}
+		case "listen_port":
+			status.ListenPort, _ = strconv.Atoi(value)
+		case "public_key":
+			flushHandshake()
+			status.Peers = append(status.Peers, control.PeerStatus{PublicKey: hexToBase64(value)})
+			peer = &status.Peers[len(status.Peers)-1]
+		}
+		if peer == nil {
+			continue
+		}
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, value)
+		case "last_handshake_time_sec":
+			handshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "persistent_keepalive_interval":
+			peer.PersistentKeepalive, _ = strconv.Atoi(value)
+		}
+	}
+	flushHandshake()
+	return status
+}
+
+func hexToBase64(hexStr string) string {
+	data, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return hexStr
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
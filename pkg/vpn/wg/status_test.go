@@ -0,0 +1,82 @@
+package wg
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/kwakubiney/safehaven/pkg/control"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseIpcGet(t *testing.T) {
+	device, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstPublic, secondPublic := first.PublicKey(), second.PublicKey()
+
+	// The layout wireguard-go writes for IpcGet, with the peer handshake split in two keys
+	state := fmt.Sprintf(`private_key=%s
+listen_port=51820
+fwmark=51820
+public_key=%s
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+protocol_version=1
+endpoint=203.0.113.7:41000
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=500
+tx_bytes=1024
+rx_bytes=2048
+persistent_keepalive_interval=25
+allowed_ip=10.108.0.2/32
+allowed_ip=fd00::2/128
+public_key=%s
+protocol_version=1
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+persistent_keepalive_interval=0
+errno=0
+`, hex.EncodeToString(device[:]), hex.EncodeToString(firstPublic[:]), hex.EncodeToString(secondPublic[:]))
+
+	handshake := time.Unix(1700000000, 500)
+	want := &control.Status{
+		PublicKey:  device.PublicKey().String(),
+		ListenPort: 51820,
+		Peers: []control.PeerStatus{
+			{
+				PublicKey:           firstPublic.String(),
+				Endpoint:            "203.0.113.7:41000",
+				AllowedIPs:          []string{"10.108.0.2/32", "fd00::2/128"},
+				LatestHandshake:     &handshake,
+				RxBytes:             2048,
+				TxBytes:             1024,
+				PersistentKeepalive: 25,
+			},
+			{PublicKey: secondPublic.String()},
+		},
+	}
+	if got := parseIpcGet(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseIpcGetMalformed(t *testing.T) {
+	// Keys before the first peer and unparsable values are skipped rather than failing the status
+	status := parseIpcGet("endpoint=1.2.3.4:5\nlisten_port=port\nno equals sign\npublic_key=zz\nrx_bytes=many\n")
+	want := &control.Status{Peers: []control.PeerStatus{{PublicKey: "zz"}}}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %+v, want %+v", status, want)
+	}
+}
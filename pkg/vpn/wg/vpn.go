@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"expvar"
 	"fmt"
 	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/pkg/dns"
+	"github.com/kwakubiney/safehaven/pkg/firewall"
+	"github.com/kwakubiney/safehaven/pkg/netconf"
 	"github.com/kwakubiney/safehaven/pkg/vpn"
 	"github.com/kwakubiney/safehaven/utils"
 	"github.com/vishvananda/netlink"
@@ -15,27 +19,91 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"log"
 	"net"
-	"strconv"
+	"net/netip"
+	"strings"
+	"sync"
 )
 
+// overhead is what WireGuard adds to every packet: the outer headers, its 16 byte data
+// header and the 16 byte authentication tag
+const overhead = netconf.OuterHeaderLen + 32
+
 type WireGuardVPN struct {
 	config     *config.Config
 	wgDevice   *device.Device
 	tunDevice  tun.Device
 	privateKey wgtypes.Key
 	publicKey  wgtypes.Key
+	undo       netconf.Undo
+	teardownMu sync.Mutex
+	// killSwitch is set while the kill switch is on
+	killSwitch *firewall.KillSwitch
+	// routes are the client routes currently through the tunnel
+	routes *netconf.TunnelRoutes
+	// peerRoutes are the server routes added for each peer, keyed by public key
+	peerRoutes map[string][]*net.IPNet
 }
 
 func NewWireGuardVPN(config *config.Config) vpn.VPNService {
 	log.Println("Initializing SafeHaven WireGuard VPN service...")
-	return &WireGuardVPN{
+	w := &WireGuardVPN{
 		config: config,
 	}
+	w.routes = netconf.NewTunnelRoutes(config, &w.undo, func() ([]netip.AddrPort, error) {
+		return firewall.ServerEndpoints(w.config, w.killSwitch)
+	})
+	return w
 }
 
 func (w *WireGuardVPN) Start(ctx context.Context) error {
+	w.publishMetrics()
+
+	if err := w.start(); err != nil {
+		log.Println("Startup failed, reverting network changes...")
+		if teardownErr := w.teardown(); teardownErr != nil {
+			log.Printf("Error during teardown: %v", teardownErr)
+		}
+		return err
+	}
+	log.Println("SafeHaven VPN started successfully")
+	// Wait for context cancellation to initiate shutdown
+	<-ctx.Done()
+	log.Println("Context cancelled, initiating WireGuard VPN shutdown...")
+	return nil
+}
+
+func (w *WireGuardVPN) Stop() error {
+	err := w.teardown()
+	log.Println("WireGuard VPN shutdown complete")
+	return err
+}
+
+// teardown reverts the routes and addresses we added, newest first, then closes the
+// WireGuard device, which also closes the TUN device. It is safe to call more than once.
+func (w *WireGuardVPN) teardown() error {
+	w.teardownMu.Lock()
+	defer w.teardownMu.Unlock()
+
+	err := w.undo.Run()
+	if w.wgDevice != nil {
+		w.wgDevice.Close()
+		w.wgDevice = nil
+		w.tunDevice = nil
+	}
+	if w.tunDevice != nil {
+		w.tunDevice.Close()
+		w.tunDevice = nil
+	}
+	return err
+}
+
+func (w *WireGuardVPN) start() error {
 	log.Println("Setting up WireGuard TUN device...")
-	tunDevice, err := tun.CreateTUN(w.config.TunName, 1500)
+	mtu, err := netconf.TunnelMTU(w.config, overhead)
+	if err != nil {
+		return err
+	}
+	tunDevice, err := tun.CreateTUN(w.config.TunName, mtu)
 	if err != nil {
 		return fmt.Errorf("failed to create TUN device: %w", err)
 	}
@@ -44,11 +112,22 @@ func (w *WireGuardVPN) Start(ctx context.Context) error {
 	w.tunDevice = tunDevice
 	w.tunDevice.Events()
 
+	if w.config.KillSwitch && !w.config.ServerMode {
+		killSwitch, err := firewall.ClientKillSwitch(w.config)
+		if err != nil {
+			return err
+		}
+		if err := killSwitch.Enable(&w.undo); err != nil {
+			return err
+		}
+		w.killSwitch = killSwitch
+	}
+
 	err = w.assignIPToTun()
 	if err != nil {
 		return fmt.Errorf("failed to assign IP to TUN device: %w", err)
 	}
-	log.Printf("TUN interface IP configured: %s", w.config.ServerMode)
+	log.Println("TUN interface IP configured")
 
 	err = w.createRoutes()
 	if err != nil {
@@ -56,6 +135,23 @@ func (w *WireGuardVPN) Start(ctx context.Context) error {
 	}
 	log.Println("Network routes configured successfully")
 
+	if !w.config.ServerMode {
+		err = w.configureDNS()
+		if err != nil {
+			return fmt.Errorf("failed to configure DNS: %w", err)
+		}
+	}
+
+	if w.config.ServerMode && w.config.NATInterface != "" {
+		subnets, err := firewall.TunnelSubnets(w.config)
+		if err != nil {
+			return err
+		}
+		if err := firewall.EnableNAT(&w.undo, w.config.NATInterface, subnets); err != nil {
+			return err
+		}
+	}
+
 	if w.config.ServerMode {
 		log.Println("Starting VPN in server mode...")
 		err = w.setupWireGuardServer()
@@ -64,18 +160,8 @@ func (w *WireGuardVPN) Start(ctx context.Context) error {
 		err = w.setupWireGuardClient()
 	}
 	if err != nil {
-		tunDevice.Close()
 		return fmt.Errorf("failed to setup WireGuard: %w", err)
 	}
-	log.Println("SafeHaven VPN started successfully")
-	// Wait for context cancellation to initiate shutdown
-	<-ctx.Done()
-	log.Println("Context cancelled, initiating WireGuard VPN shutdown...")
-	return nil
-}
-
-func (w *WireGuardVPN) Stop() error {
-	w.tunDevice.Close()
 	return nil
 }
 
@@ -93,24 +179,37 @@ func (w *WireGuardVPN) setupWireGuardServer() error {
 	wgDevice := device.NewDevice(w.tunDevice, conn.NewDefaultBind(), logger)
 	w.wgDevice = wgDevice
 
-	hexEncodedClientPublicKey, hexEncodedServerPrivateKey, err :=
-		convertPublicAndPrivateKeyToHex(w.config.WireGuardConfig.ClientPublicKey,
-			w.config.WireGuardConfig.ServerPrivateKey)
-
-	ipcRequest := fmt.Sprintf(`private_key=%s
-listen_port=%s
-public_key=%s
-allowed_ip=%s
-`,
+	hexEncodedServerPrivateKey, err := base64ToHex(w.config.WireGuardConfig.OwnPrivateKey(true))
+	if err != nil {
+		return fmt.Errorf("failed to convert private key to hexadecimal: %w", err)
+	}
+	ipcRequest := fmt.Sprintf("private_key=%s\nlisten_port=%s\n",
 		hexEncodedServerPrivateKey,
 		w.config.LocalAddress,
-		hexEncodedClientPublicKey,                 // Client's public key
-		w.config.WireGuardConfig.ServerAllowedIPs, // Allowed IPs for the client)
 	)
+	if w.config.WireGuardConfig.ClientPublicKey != "" {
+		// The single client peer from the WireGuard configuration file
+		hexEncodedClientPublicKey, err := base64ToHex(w.config.WireGuardConfig.ClientPublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to convert public key to hexadecimal: %w", err)
+		}
+		peerSettings, err := peerSettingsRequest(w.config.WireGuardConfig.PresharedKey, w.config.WireGuardConfig.PersistentKeepalive)
+		if err != nil {
+			return err
+		}
+		ipcRequest += fmt.Sprintf("public_key=%s\n%s%s",
+			hexEncodedClientPublicKey,
+			peerSettings,
+			allowedIPsRequest(utils.SplitAddressList(w.config.WireGuardConfig.ServerAllowedIPs)), // Allowed IPs for the client
+		)
+	}
 
 	if err := wgDevice.IpcSet(ipcRequest); err != nil {
 		return fmt.Errorf("failed to configure WireGuard server: %w", err)
 	}
+	if err := w.setupPeers(); err != nil {
+		return err
+	}
 
 	err = wgDevice.Up()
 	if err != nil {
@@ -133,90 +232,165 @@ func (w *WireGuardVPN) setupWireGuardClient() error {
 	wgDevice := device.NewDevice(w.tunDevice, conn.NewDefaultBind(), logger)
 	w.wgDevice = wgDevice
 
-	host, portStr, err := net.SplitHostPort(w.config.ServerAddress)
+	ipcRequest, err := w.clientRequest()
+	if err != nil {
+		return err
+	}
+	if err := wgDevice.IpcSet(ipcRequest); err != nil {
+		return fmt.Errorf("failed to configure WireGuard client: %w", err)
+	}
+
+	err = wgDevice.Up()
 	if err != nil {
-		return fmt.Errorf("invalid server address format: %w", err)
+		return fmt.Errorf("failed to bring up WireGuard client: %w", err)
 	}
-	port, err := strconv.Atoi(portStr)
+
+	return nil
+}
+
+// clientRequest builds the UAPI request configuring the client and its server peer. The UAPI
+// only takes an address as endpoint, so a server host name is resolved here.
+func (w *WireGuardVPN) clientRequest() (string, error) {
+	endpoints, err := firewall.ServerEndpoints(w.config, w.killSwitch)
 	if err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+		return "", err
+	}
+	if len(endpoints) == 0 {
+		return "", fmt.Errorf("server %s has no address", w.config.ServerAddress)
 	}
 
 	hexEncodedServerPublicKey, hexEncodedClientPrivateKey, err :=
 		convertPublicAndPrivateKeyToHex(w.config.WireGuardConfig.ServerPublicKey,
-			w.config.WireGuardConfig.ClientPrivateKey)
+			w.config.WireGuardConfig.OwnPrivateKey(false))
 
 	if err != nil {
-		return fmt.Errorf("failed to convert public and private keys to hexadecimal: %w", err)
+		return "", fmt.Errorf("failed to convert public and private keys to hexadecimal: %w", err)
 	}
 
-	ipcRequest := fmt.Sprintf(`private_key=%s
+	peerSettings, err := peerSettingsRequest(w.config.WireGuardConfig.PresharedKey, w.config.WireGuardConfig.PersistentKeepalive)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`private_key=%s
 listen_port=%s
-public_key=%s
-endpoint=%s:%d
-allowed_ip=%s`,
+%spublic_key=%s
+%sendpoint=%s
+%s`,
 		hexEncodedClientPrivateKey,
 		w.config.LocalAddress,
+		fwmarkRequest(w.config),
 		hexEncodedServerPublicKey,
-		host, port,
-		w.config.DestinationAddress,
-	)
+		peerSettings, // Preshared key and keepalive, to survive idle NAT mappings
+		endpoints[0],
+		allowedIPsRequest(w.routes.Strings()), // Allow exactly what we route through the tunnel
+	), nil
+}
 
-	if err := wgDevice.IpcSet(ipcRequest); err != nil {
-		return fmt.Errorf("failed to configure WireGuard client: %w", err)
+func (w *WireGuardVPN) assignIPToTun() error {
+	tunnelIPs := w.config.ClientTunIP
+	if w.config.ServerMode {
+		tunnelIPs = w.config.ServerTunIP
 	}
 
-	err = wgDevice.Up()
+	tunLink, err := netlink.LinkByName(w.config.TunName)
 	if err != nil {
-		return fmt.Errorf("failed to bring up WireGuard client: %w", err)
+		return err
 	}
 
-	return nil
-}
-
-func (w *WireGuardVPN) assignIPToTun() error {
-	if !w.config.ServerMode {
-		tunLink, err := netlink.LinkByName(w.config.TunName)
+	for _, tunnelIP := range utils.SplitAddressList(tunnelIPs) {
+		parsedTunIPAddress, err := netlink.ParseAddr(tunnelIP)
 		if err != nil {
 			return err
 		}
 
-		parsedTunIPAddress, err := netlink.ParseAddr(w.config.ClientTunIP)
+		err = w.undo.AddrAdd(tunLink, parsedTunIPAddress)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = netlink.AddrAdd(tunLink, parsedTunIPAddress)
-		if err != nil {
-			return err
-		}
+	err = w.undo.LinkSetUp(tunLink)
+	if err != nil {
+		return err
+	}
+	return nil
+}
 
-		err = netlink.LinkSetUp(tunLink)
-		if err != nil {
-			return err
-		}
-	} else {
-		tunLink, err := netlink.LinkByName(w.config.TunName)
-		if err != nil {
-			return err
-		}
+// fwmarkRequest marks the WireGuard socket when tunnel routes live in their own table, so the
+// encrypted packets bypass the policy rules
+func fwmarkRequest(cfg *config.Config) string {
+	if cfg.RouteTable == 0 {
+		return ""
+	}
+	return fmt.Sprintf("fwmark=%d\n", cfg.FwMark)
+}
 
-		parsedTunIPAddress, err := netlink.ParseAddr(w.config.ServerTunIP)
-		if err != nil {
-			return err
-		}
+// configureDNS applies the client's own DNS settings, as there is no control channel for the
+// server to push them over, or starts the split DNS forwarder on the first tunnel address
+func (w *WireGuardVPN) configureDNS() error {
+	if len(w.config.DNSForward) == 0 {
+		return dns.Apply(&w.undo, w.config.TunName, dns.Settings{
+			Servers:       w.config.DNSServers,
+			SearchDomains: w.config.SearchDomains,
+			Default:       w.config.Global,
+		})
+	}
+	rules, err := dns.ParseRules(w.config.DNSForward)
+	if err != nil {
+		return err
+	}
+	tunnelIP := utils.SplitAddressList(w.config.ClientTunIP)[0]
+	listenIP := net.ParseIP(utils.RemoveCIDRSuffix(tunnelIP, "/"))
+	return dns.Forward(&w.undo, w.config.TunName, listenIP, rules)
+}
+
+// publishedMetrics guards against publishing twice, which expvar panics on
+var publishedMetrics sync.Once
+
+// publishMetrics publishes the peer counters over expvar when metrics are enabled. Only the
+// first service started in the process is published.
+func (w *WireGuardVPN) publishMetrics() {
+	if w.config.MetricsAddress == "" {
+		return
+	}
+	publishedMetrics.Do(func() {
+		expvar.Publish("wireguard", expvar.Func(w.metrics))
+	})
+}
 
-		err = netlink.AddrAdd(tunLink, parsedTunIPAddress)
+func (w *WireGuardVPN) metrics() interface{} {
+	stats, err := w.Stats()
+	if err != nil {
+		return nil
+	}
+	return stats
+}
+
+// peerSettingsRequest renders the UAPI preshared key and persistent keepalive lines of a peer.
+// An empty preshared key clears any previous one and a zero interval turns keepalives off.
+func peerSettingsRequest(presharedKey string, keepalive int) (string, error) {
+	hexEncodedPresharedKey := strings.Repeat("0", 64)
+	if presharedKey != "" {
+		var err error
+		hexEncodedPresharedKey, err = base64ToHex(presharedKey)
 		if err != nil {
-			return err
+			return "", fmt.Errorf("failed to convert preshared key to hexadecimal: %w", err)
 		}
+	}
+	return fmt.Sprintf("preshared_key=%s\npersistent_keepalive_interval=%d\n", hexEncodedPresharedKey, keepalive), nil
+}
 
-		err = netlink.LinkSetUp(tunLink)
-		if err != nil {
-			return err
+// allowedIPsRequest renders one UAPI allowed_ip line per address, accepting bare IPs as host routes
+func allowedIPsRequest(allowedIPs []string) string {
+	var request strings.Builder
+	for _, allowedIP := range allowedIPs {
+		if prefix, err := utils.ParsePrefix(allowedIP); err == nil {
+			allowedIP = prefix.String()
 		}
+		fmt.Fprintf(&request, "allowed_ip=%s\n", allowedIP)
 	}
-	return nil
+	return request.String()
 }
 
 func base64ToHex(base64Str string) (string, error) {
@@ -255,51 +429,39 @@ func (w *WireGuardVPN) createRoutes() error {
 	}
 
 	if !w.config.ServerMode {
-		if w.config.Global {
-			// Add default route (0.0.0.0/0) with lower metric to override existing default route
-			defaultDst, _ := netlink.ParseIPNet("0.0.0.0/0")
-			defaultRoute := &netlink.Route{
-				LinkIndex: link.Attrs().Index,
-				Dst:       defaultDst,
-				Priority:  50,
-			}
-
-			if err := netlink.RouteAdd(defaultRoute); err != nil {
-				return fmt.Errorf("failed to add default route with lower metric: %w", err)
+		routes, err := netconf.ClientRoutes(w.config, utils.SplitAddressList(w.config.ClientTunIP))
+		if err != nil {
+			return err
+		}
+		if err := w.routes.Add(routes); err != nil {
+			return err
+		}
+		if w.config.RouteTable != 0 {
+			if err := w.undo.AddPolicyRules(w.config.RouteTable, w.config.FwMark, routes); err != nil {
+				return err
 			}
-		} else {
-			// Add route for specific destination through TUN
-			dst, err := netlink.ParseIPNet(w.config.DestinationAddress)
+		}
+	} else if w.config.WireGuardConfig.ClientPublicKey != "" {
+		// Server mode: Add route to reply back to the legacy client peer. The routes of the
+		// other peers follow their allowed IPs.
+		for _, clientTunIP := range utils.SplitAddressList(w.config.ClientTunIP) {
+			// Parse client IP without CIDR suffix
+			clientIP := utils.RemoveCIDRSuffix(clientTunIP, "/")
+
+			// Create a /32 or /128 network for the single IP
+			dst, err := utils.ParsePrefix(clientIP)
 			if err != nil {
-				return fmt.Errorf("invalid destination address %s: %w", w.config.DestinationAddress, err)
+				return fmt.Errorf("invalid client IP %s: %w", clientIP, err)
 			}
 
 			route := &netlink.Route{
 				LinkIndex: link.Attrs().Index,
 				Dst:       dst,
 			}
-			if err := netlink.RouteAdd(route); err != nil {
-				return fmt.Errorf("failed to add route for %s: %w", w.config.DestinationAddress, err)
+			if err := w.undo.RouteAdd(route); err != nil {
+				return fmt.Errorf("failed to add route for client %s: %w", clientIP, err)
 			}
 		}
-	} else {
-		// Server mode: Add route to reply back to client
-		// Parse client IP without CIDR suffix
-		clientIP := utils.RemoveCIDRSuffix(w.config.ClientTunIP, "/")
-
-		// Create a /32 network for the single IP
-		dst, err := netlink.ParseIPNet(clientIP + "/32")
-		if err != nil {
-			return fmt.Errorf("invalid client IP %s: %w", clientIP, err)
-		}
-
-		route := &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst:       dst,
-		}
-		if err := netlink.RouteAdd(route); err != nil {
-			return fmt.Errorf("failed to add route for client %s: %w", clientIP, err)
-		}
 	}
 	return nil
 }
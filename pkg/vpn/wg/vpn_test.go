@@ -0,0 +1,76 @@
+package wg
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/kwakubiney/safehaven/config"
+	"github.com/kwakubiney/safehaven/wg"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestClientRequestResolvesQuickEndpoint(t *testing.T) {
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quick, err := wg.ParseQuickConfig(strings.NewReader(fmt.Sprintf(`
+[Interface]
+PrivateKey = %s
+Address = 10.108.0.2/24
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 10.108.0.0/24
+Endpoint = localhost:51820
+`, clientKey, serverKey.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{LocalAddress: "51821"}
+	if err := cfg.ApplyQuick(quick); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := NewWireGuardVPN(cfg).(*WireGuardVPN).clientRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var endpoint string
+	for _, line := range strings.Split(request, "\n") {
+		if strings.HasPrefix(line, "endpoint=") {
+			endpoint = strings.TrimPrefix(line, "endpoint=")
+		}
+	}
+	if endpoint == "" {
+		t.Fatalf("request has no endpoint:\n%s", request)
+	}
+	// The UAPI hands the endpoint to the bind, which only takes addresses
+	if _, err := conn.NewDefaultBind().ParseEndpoint(endpoint); err != nil {
+		t.Fatalf("endpoint %q is not accepted by the bind: %v", endpoint, err)
+	}
+	addrPort := netip.MustParseAddrPort(endpoint)
+	if !addrPort.Addr().IsLoopback() || addrPort.Port() != 51820 {
+		t.Errorf("endpoint %s, want localhost port 51820", addrPort)
+	}
+}
+
+func TestPublishMetricsOnce(t *testing.T) {
+	(&WireGuardVPN{config: &config.Config{}}).publishMetrics()
+	if expvar.Get("wireguard") != nil {
+		t.Fatal("published without metrics enabled")
+	}
+	for i := 0; i < 2; i++ {
+		(&WireGuardVPN{config: &config.Config{MetricsAddress: "127.0.0.1:9100"}}).publishMetrics()
+	}
+	if expvar.Get("wireguard") == nil {
+		t.Error("not published with metrics enabled")
+	}
+}
@@ -1,19 +1,96 @@
 package utils
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
-func ResolveSourceIPAddressFromRawPacket(packet []byte) string {
-	return net.IPv4(packet[12], packet[13], packet[14], packet[15]).To4().String()
+func RemoveCIDRSuffix(str, suffix string) string {
+	re := regexp.MustCompile(suffix + `.*$`)
+	return re.ReplaceAllString(str, "")
 }
 
-func ResolveDestinationIPAddressFromRawPacket(packet []byte) string {
-	return net.IPv4(packet[16], packet[17], packet[18], packet[19]).To4().String()
+// SplitAddressList splits a comma separated list of addresses such as "10.0.0.2/24,fd00::2/64"
+func SplitAddressList(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
 }
 
-func RemoveCIDRSuffix(str, suffix string) string {
-	re := regexp.MustCompile(suffix + `.*$`)
-	return re.ReplaceAllString(str, "")
+// ParsePrefix parses a CIDR, treating a bare IPv4 or IPv6 address as a single host
+func ParsePrefix(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: str}
+		}
+		return HostPrefix(ip), nil
+	}
+	_, prefix, err := net.ParseCIDR(str)
+	return prefix, err
+}
+
+// HostPrefix returns the /32 or /128 network holding only ip
+func HostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// DefaultRoutes returns the default route of every address family used by addresses
+func DefaultRoutes(addresses []string) []*net.IPNet {
+	var hasIPv4, hasIPv6 bool
+	for _, address := range addresses {
+		ip := net.ParseIP(RemoveCIDRSuffix(address, "/"))
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	var routes []*net.IPNet
+	if hasIPv4 {
+		routes = append(routes, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+	}
+	if hasIPv6 {
+		routes = append(routes, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+	}
+	return routes
+}
+
+// ResolveEndpoints resolves host:port server addresses to every address their host has
+func ResolveEndpoints(servers []string) ([]netip.AddrPort, error) {
+	var endpoints []netip.AddrPort
+	for _, server := range servers {
+		host, portStr, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server address %s: %w", server, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in server address %s: %w", server, err)
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server %s: %w", host, err)
+		}
+		for _, ip := range ips {
+			addr, _ := netip.AddrFromSlice(ip)
+			endpoints = append(endpoints, netip.AddrPortFrom(addr.Unmap(), uint16(port)))
+		}
+	}
+	return endpoints, nil
 }
@@ -2,20 +2,51 @@ package wg
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 )
 
-// WireGuardConfig represents the WireGuard configuration
+// WireGuardConfig represents the WireGuard configuration of one node: its own private key
+// and the public keys of the other end. Private keys never leave the node they belong to.
 type WireGuardConfig struct {
-	ClientPrivateKey string `json:"client_private_key"`
+	// PrivateKey is this node's private key, or read from PrivateKeyFile
+	PrivateKey     string `json:"private_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+	// ServerPublicKey identifies the server to a client
+	ServerPublicKey string `json:"server_public_key"`
+	// ClientPublicKey and ServerAllowedIPs describe a single client to a server, more can be
+	// listed as peers
 	ClientPublicKey  string `json:"client_public_key"`
-	ServerPrivateKey string `json:"server_private_key"`
-	ServerPublicKey  string `json:"server_public_key"`
 	ServerAllowedIPs string `json:"server_allowed_ips"`
+	// PresharedKey and PersistentKeepalive, in seconds, apply to the server on a client and
+	// to the single client on a server
+	PresharedKey        string `json:"preshared_key"`
+	PersistentKeepalive int    `json:"persistent_keepalive_interval"`
+
+	// Deprecated: ClientPrivateKey and ServerPrivateKey hold the private keys of both ends in
+	// one file. They are only used when PrivateKey is not set.
+	ClientPrivateKey string `json:"client_private_key"`
+	ServerPrivateKey string `json:"server_private_key"`
 }
 
-// loadWireGuardConfig loads the WireGuard configuration from a JSON file
+// OwnPrivateKey returns this node's private key, falling back to the matching legacy key
+func (c *WireGuardConfig) OwnPrivateKey(serverMode bool) string {
+	switch {
+	case c.PrivateKey != "":
+		return c.PrivateKey
+	case serverMode:
+		return c.ServerPrivateKey
+	default:
+		return c.ClientPrivateKey
+	}
+}
+
+// loadWireGuardConfig loads the WireGuard configuration from a JSON file, along with the
+// private key file it points to. Files holding a private or preshared key must not be
+// world-readable.
 func LoadWireGuardConfig(filepath string) (*WireGuardConfig, error) {
 	file, err := os.ReadFile(filepath)
 	if err != nil {
@@ -26,5 +57,39 @@ func LoadWireGuardConfig(filepath string) (*WireGuardConfig, error) {
 	if err := json.Unmarshal(file, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if config.PrivateKey != "" || config.ClientPrivateKey != "" || config.ServerPrivateKey != "" || config.PresharedKey != "" {
+		if err := CheckPrivateFile(filepath); err != nil {
+			return nil, err
+		}
+	}
+	if config.ClientPrivateKey != "" && config.ServerPrivateKey != "" {
+		log.Printf("Warning: %s holds the private keys of both ends, give each node its own private_key", filepath)
+	}
+
+	if config.PrivateKeyFile != "" {
+		if config.PrivateKey != "" {
+			return nil, errors.New("set either private_key or private_key_file, not both")
+		}
+		if err := CheckPrivateFile(config.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key file: %w", err)
+		}
+		config.PrivateKey = strings.TrimSpace(string(key))
+	}
 	return &config, nil
 }
+
+// CheckPrivateFile refuses files that anyone on the host can read, as they hold private keys
+func CheckPrivateFile(filepath string) error {
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o004 != 0 {
+		return fmt.Errorf("%s holds a private key but is world-readable, run chmod 600 %s", filepath, filepath)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package wg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ignoredQuickKeys are wg-quick keys that mean nothing to SafeHaven but are too common to
+// reject files for
+var ignoredQuickKeys = map[string]bool{
+	"saveconfig": true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+}
+
+// QuickConfig is a wg-quick style configuration with an [Interface] section and a [Peer]
+// section per peer
+type QuickConfig struct {
+	Interface QuickInterface
+	Peers     []QuickPeer
+}
+
+type QuickInterface struct {
+	PrivateKey string
+	Address    []string
+	// DNS holds DNS servers and search domains, as wg-quick mixes them
+	DNS        []string
+	ListenPort int
+	MTU        int
+	// Table is the routing table for the routes, 0 for the main table
+	Table  int
+	FwMark int
+}
+
+type QuickPeer struct {
+	PublicKey           string
+	PresharedKey        string
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+// IsQuickConfig reports whether the file at path is a wg-quick configuration rather than
+// the JSON key file, going by its .conf extension
+func IsQuickConfig(path string) bool {
+	return filepath.Ext(path) == ".conf"
+}
+
+// LoadQuickConfig loads a wg-quick configuration file, which must not be world-readable
+func LoadQuickConfig(filepath string) (*QuickConfig, error) {
+	if err := CheckPrivateFile(filepath); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer file.Close()
+
+	config, err := ParseQuickConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", filepath, err)
+	}
+	return config, nil
+}
+
+// ParseQuickConfig parses a wg-quick configuration. Keys are case insensitive like in
+// wg-quick. SaveConfig and the PreUp, PostUp, PreDown and PostDown hooks are logged and
+// ignored, and other keys SafeHaven does not support are rejected.
+func ParseQuickConfig(r io.Reader) (*QuickConfig, error) {
+	var config QuickConfig
+	var peer *QuickPeer
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				config.Peers = append(config.Peers, QuickPeer{})
+				peer = &config.Peers[len(config.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section [%s]", lineNumber, section)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		name := strings.TrimSpace(key)
+		key = strings.ToLower(name)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch {
+		case section == "interface" && key == "privatekey":
+			config.Interface.PrivateKey = value
+		case section == "interface" && key == "address":
+			config.Interface.Address = append(config.Interface.Address, splitList(value)...)
+		case section == "interface" && key == "dns":
+			config.Interface.DNS = append(config.Interface.DNS, splitList(value)...)
+		case section == "interface" && key == "listenport":
+			config.Interface.ListenPort, err = strconv.Atoi(value)
+		case section == "interface" && key == "mtu":
+			config.Interface.MTU, err = strconv.Atoi(value)
+		case section == "interface" && key == "table":
+			config.Interface.Table, err = parseTable(value)
+		case section == "interface" && key == "fwmark":
+			if value != "off" {
+				var mark uint64
+				mark, err = strconv.ParseUint(value, 0, 32)
+				config.Interface.FwMark = int(mark)
+			}
+		case section == "interface" && ignoredQuickKeys[key]:
+			log.Printf("Ignoring %s on line %d, SafeHaven does not run wg-quick hooks or save its config", name, lineNumber)
+		case section == "peer" && key == "publickey":
+			peer.PublicKey = value
+		case section == "peer" && key == "presharedkey":
+			peer.PresharedKey = value
+		case section == "peer" && key == "allowedips":
+			peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+		case section == "peer" && key == "endpoint":
+			peer.Endpoint = value
+		case section == "peer" && key == "persistentkeepalive":
+			if value != "off" {
+				peer.PersistentKeepalive, err = strconv.Atoi(value)
+			}
+		case section == "":
+			return nil, fmt.Errorf("line %d: %s is outside of a section", lineNumber, key)
+		default:
+			return nil, fmt.Errorf("line %d: unsupported key %s in [%s]", lineNumber, key, section)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s: %w", lineNumber, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if config.Interface.PrivateKey == "" {
+		return nil, fmt.Errorf("[Interface] has no PrivateKey")
+	}
+	for i, peer := range config.Peers {
+		if peer.PublicKey == "" {
+			return nil, fmt.Errorf("[Peer] %d has no PublicKey", i+1)
+		}
+	}
+	return &config, nil
+}
+
+// parseTable parses the Table key: a table number, or auto or main for the main table
+func parseTable(value string) (int, error) {
+	switch value {
+	case "auto", "main":
+		return 0, nil
+	case "off":
+		return 0, errors.New("off is not supported, SafeHaven always routes the allowed IPs")
+	}
+	table, err := strconv.Atoi(value)
+	if err != nil || table <= 0 {
+		return 0, errors.New("expected a table number, auto or main")
+	}
+	return table, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
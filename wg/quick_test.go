@@ -0,0 +1,115 @@
+package wg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuickConfig(t *testing.T) {
+	input := `
+# A client config as wg-quick writes it
+[Interface]
+PrivateKey = cGl2YXRla2V5
+Address = 10.108.0.2/24, fd00::2/64
+DNS = 10.108.0.1, corp.internal
+ListenPort = 51821
+MTU = 1380
+Table = 51820
+FwMark = 0xca6c
+SaveConfig = true
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PreDown = true
+
+[Peer]
+publickey = cHVibGlja2V5
+PresharedKey = cHNr
+AllowedIPs = 0.0.0.0/0
+AllowedIPs = ::/0
+Endpoint = vpn.example.com:51820 # comments run to the end of the line
+PersistentKeepalive = 25
+`
+	want := &QuickConfig{
+		Interface: QuickInterface{
+			PrivateKey: "cGl2YXRla2V5",
+			Address:    []string{"10.108.0.2/24", "fd00::2/64"},
+			DNS:        []string{"10.108.0.1", "corp.internal"},
+			ListenPort: 51821,
+			MTU:        1380,
+			Table:      51820,
+			FwMark:     0xca6c,
+		},
+		Peers: []QuickPeer{{
+			PublicKey:           "cHVibGlja2V5",
+			PresharedKey:        "cHNr",
+			AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+			Endpoint:            "vpn.example.com:51820",
+			PersistentKeepalive: 25,
+		}},
+	}
+
+	got, err := ParseQuickConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseQuickConfigKeywords(t *testing.T) {
+	tests := []struct {
+		line          string
+		wantTable     int
+		wantFwMark    int
+		wantKeepalive int
+	}{
+		{line: "[Interface]\nTable = auto"},
+		{line: "[Interface]\nTable = main"},
+		{line: "[Interface]\nTable = 200", wantTable: 200},
+		{line: "[Interface]\nFwMark = off"},
+		{line: "[Interface]\nFwMark = 51820", wantFwMark: 51820},
+		{line: "[Peer]\nPublicKey = cHVibGlja2V5\nPersistentKeepalive = off"},
+		{line: "[Peer]\nPublicKey = cHVibGlja2V5\nPersistentKeepalive = 25", wantKeepalive: 25},
+	}
+	for _, test := range tests {
+		got, err := ParseQuickConfig(strings.NewReader("[Interface]\nPrivateKey = cGl2YXRla2V5\n" + test.line))
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		var keepalive int
+		if len(got.Peers) > 0 {
+			keepalive = got.Peers[0].PersistentKeepalive
+		}
+		if got.Interface.Table != test.wantTable || got.Interface.FwMark != test.wantFwMark || keepalive != test.wantKeepalive {
+			t.Errorf("%q: got table %d, fwmark %d, keepalive %d", test.line, got.Interface.Table, got.Interface.FwMark, keepalive)
+		}
+	}
+}
+
+func TestParseQuickConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"key outside a section", "PrivateKey = cGl2YXRla2V5"},
+		{"unknown section", "[Interface]\nPrivateKey = cGl2YXRla2V5\n[Tunnel]"},
+		{"unsupported key", "[Interface]\nPrivateKey = cGl2YXRla2V5\nRouting = on"},
+		{"peer key in interface", "[Interface]\nPrivateKey = cGl2YXRla2V5\nEndpoint = 1.2.3.4:51820"},
+		{"hook in peer", "[Interface]\nPrivateKey = cGl2YXRla2V5\n[Peer]\nPublicKey = cHVibGlja2V5\nPostUp = true"},
+		{"missing equals", "[Interface]\nPrivateKey"},
+		{"no private key", "[Interface]\nAddress = 10.108.0.2/24"},
+		{"peer without public key", "[Interface]\nPrivateKey = cGl2YXRla2V5\n[Peer]\nEndpoint = 1.2.3.4:51820"},
+		{"invalid port", "[Interface]\nPrivateKey = cGl2YXRla2V5\nListenPort = port"},
+		{"table off", "[Interface]\nPrivateKey = cGl2YXRla2V5\nTable = off"},
+		{"named table", "[Interface]\nPrivateKey = cGl2YXRla2V5\nTable = vpn"},
+		{"invalid fwmark", "[Interface]\nPrivateKey = cGl2YXRla2V5\nFwMark = mark"},
+		{"invalid keepalive", "[Interface]\nPrivateKey = cGl2YXRla2V5\n[Peer]\nPublicKey = cHVibGlja2V5\nPersistentKeepalive = often"},
+	}
+	for _, test := range tests {
+		if _, err := ParseQuickConfig(strings.NewReader(test.input)); err == nil {
+			t.Errorf("%s: parsed without error", test.name)
+		}
+	}
+}